@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"github.com/gorilla/websocket"
@@ -11,6 +12,7 @@ import (
 type ApplicationStatus struct {
 	Status          string            `json:"status"`
 	SubApplications []*SubApplication `json:"subApplications"`
+	States          []*AppState       `json:"states"` // Runtime state of the applications
 }
 
 var upgrader = websocket.Upgrader{
@@ -22,16 +24,23 @@ var upgrader = websocket.Upgrader{
 }
 
 type MessageRequest struct {
-	Request   string            `json:"request"`
-	RequestId string            `json:"requestId"`
-	App       SubApplication    `json:"app"`
-	Config    map[string]string `json:"config"`
+	Request    string            `json:"request"`
+	RequestId  string            `json:"requestId"`
+	App        SubApplication    `json:"app"`
+	Config     json.RawMessage   `json:"config"`
+	Node       NodeRequest       `json:"node"`
+	Parameters map[string]string `json:"parameters"`
+	Query      KitQuery          `json:"query"`
+	Export     KitExportRequest  `json:"export"`
+	History    HistoryRequest    `json:"history"`
+	Secret     Secret            `json:"secret"`
 }
 
 type DeamonStatus struct {
 	Name            string            `json:"name"`
 	Config          Config            `json:"config"`
 	SubApplications []*SubApplication `json:"subApplications"`
+	States          []*AppState       `json:"states"` // Runtime state of the applications
 }
 
 type ResponseSocket struct {
@@ -47,25 +56,54 @@ var broadcast_response = make(chan interface{})
 func startServer() error {
 
 	http.HandleFunc("/config", changeConfig)
+	http.HandleFunc("/config/effective", effectiveConfig)
+	http.HandleFunc("/history", listHistory)
+	http.HandleFunc("/history/diff", diffHistoryVersions)
+	http.HandleFunc("/history/rollback", rollbackHistoryVersion)
 	http.HandleFunc("/flags", listFlags)
 	http.HandleFunc("/diskinfo", listDiskSpace)
 
 	http.HandleFunc("/status", apiStatus)
 	http.HandleFunc("/app", applicationOperation)
 	http.HandleFunc("/applications", listApplications)
+	http.HandleFunc("/applications/state", listStates)
+	http.HandleFunc("/apps/", appResource)
+	http.HandleFunc("/credentials", credentialsOperation)
+	http.HandleFunc("/secrets", secretsOperation)
 	http.HandleFunc("/kits", listKits)
+	http.HandleFunc("/kits/catalog", kitCatalog)
 	http.HandleFunc("/ws", wsHandler)
-	go broadcastMessages()
-	err := http.ListenAndServe(":8180", nil)
+	listeners, err := listenAll()
 	if err != nil {
 		return err
 	}
+	serveAll(listeners, http.DefaultServeMux)
 
 	return nil
 }
 
+// listKits returns the kits with their install state, filtered by ?q=, ?tag=, ?category= and ?state=
 func listKits(w http.ResponseWriter, r *http.Request) {
-	obj := getAllKits()
+	params := r.URL.Query()
+	query := KitQuery{Text: params.Get("q"), Category: params.Get("category"), State: params.Get("state")}
+	for _, tags := range params["tag"] {
+		for _, tag := range strings.Split(tags, ",") {
+			if strings.TrimSpace(tag) != "" {
+				query.Tags = append(query.Tags, tag)
+			}
+		}
+	}
+	obj := searchKits(query)
+	handleJsonAndError(w, obj, nil)
+}
+
+// kitCatalog returns the kits with the cache state of each source, ?refresh=true revalidates them
+func kitCatalog(w http.ResponseWriter, r *http.Request) {
+	obj := getKitCatalog(r.URL.Query().Get("refresh") == "true")
+	for i := range obj.Kits {
+		obj.Kits[i].joinApplications()
+	}
+	defer broadcastToSocket("kits", obj.Kits)
 	handleJsonAndError(w, obj, nil)
 }
 
@@ -106,13 +144,33 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		case "restart":
 			restartService()
 		case "config":
-			updateConfigFile(msg.Config)
+			_, err := patchConfig(msg.Config, "websocket")
+			if updateErr, ok := err.(*ConfigUpdateError); ok {
+				broadcastToSocket("configerrors", updateErr)
+			} else if err != nil {
+				broadcastToSocket("configerrors", &ConfigUpdateError{Errors: []ConfigFieldError{{Field: "", Message: err.Error()}}})
+			}
+		case "configeffective":
+			getEffectiveConfig()
+		case "history":
+			versions, err := readHistory(msg.History.File)
+			if err == nil {
+				broadcastToSocket("history", versions)
+			}
+		case "historydiff":
+			changes, err := diffHistory(msg.History.File, msg.History.From, msg.History.To)
+			if err == nil {
+				broadcastToSocket("historydiff", changes)
+			}
+		case "historyrollback":
+			rollbackHistory(msg.History.File, msg.History.Version, "websocket")
 		case "diskinfo":
 			listDiskSpaceInternal()
 		case "flags":
 			msg.App.listFlags()
 		case "appadd":
-			msg.App.add()
+			request := AppRequest{SubApplication: msg.App, Parameters: msg.Parameters}
+			request.addApplication("websocket")
 		case "appinstall":
 			msg.App.install()
 		case "appupdate":
@@ -126,15 +184,45 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		case "appuninstall":
 			msg.App.uninstall()
 		case "appconfig":
-			msg.App.modify()
+			msg.App.modify("websocket")
 		case "appremove":
-			msg.App.remove()
+			msg.App.remove("websocket")
+		case "apppackages":
+			msg.App.listPythonPackages()
+		case "appnodes":
+			msg.App.nodeOperation(msg.Node)
+		case "approllback":
+			msg.App.rollback()
+		case "appkitupgrade":
+			upgrade, err := msg.App.getKitUpgrade()
+			if err == nil && upgrade != nil {
+				broadcastToSocket("kitupgrade", upgrade)
+			}
+		case "appkitapply":
+			msg.App.applyKitUpgrade(KitUpgradeRequest{}, "websocket")
+		case "apprequirements":
+			msg.App.requirementReport()
+		case "appexport":
+			export, err := msg.App.exportKit(msg.Export)
+			if err == nil {
+				broadcastToSocket("kitexport", export)
+			}
 		case "applist":
 			listApplicationsInternal()
+		case "appstates":
+			listStatesInternal()
+		case "appstate":
+			msg.App.stateReport()
 		case "status":
 			apiStatusInternal()
 		case "kits":
-			getAllKits()
+			searchKits(msg.Query)
+		case "secrets":
+			listSecrets()
+		case "secretset":
+			setSecret(msg.Secret)
+		case "secretdelete":
+			deleteSecret(msg.Secret.Name)
 
 		}
 
@@ -145,7 +233,7 @@ func broadcastToSocket(request string, data interface{}) {
 	if data == nil {
 		return
 	}
-	resp := ResponseSocket{Type: request, Data: data}
+	resp := ResponseSocket{Type: request, Data: redactSecretsData(data)}
 	// json, err := json.Marshal(resp)
 	// if err != nil {
 	// 	return
@@ -168,25 +256,91 @@ func broadcastMessages() {
 	}
 }
 
+// changeConfig returns the configuration, POST applies a JSON merge patch to it.
+// A rejected update answers 400 with the list of invalid fields.
 func changeConfig(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		handleJsonAndError(w, CurrentConfig, nil)
+		return
+	}
 	if r.Method != "POST" {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var data map[string]string
-	err := decoder.Decode(&data)
+	var patch json.RawMessage
+	err := json.NewDecoder(r.Body).Decode(&patch)
 	if err != nil {
-		handleJsonAndError(w, CurrentConfig, nil)
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	config, err := patchConfig(patch, "api "+r.RemoteAddr)
+	if updateErr, ok := err.(*ConfigUpdateError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(updateErr)
 		return
 	}
-	config, err := updateConfigFile(data)
+	// the listeners keep their settings until the daemon restarts
+	if fields := getRestartRequired(); err == nil && len(fields) > 0 {
+		w.Header().Set("X-Restart-Required", strings.Join(fields, ", "))
+	}
 
 	handleJsonAndError(w, config, err)
 
 }
 
+// effectiveConfig returns the configuration in use and the layer each value comes from
+func effectiveConfig(w http.ResponseWriter, r *http.Request) {
+	handleJsonAndError(w, getEffectiveConfig(), nil)
+}
+
+// listHistory lists the saved versions of ?file=config or ?file=subapplications
+func listHistory(w http.ResponseWriter, r *http.Request) {
+	file := r.URL.Query().Get("file")
+	if file != historyConfig && file != historySubApplications {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	obj, err := readHistory(file)
+	handleJsonAndError(w, obj, err)
+}
+
+// diffHistoryVersions compares ?from= and ?to= versions of ?file=, a missing version is the current state
+func diffHistoryVersions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if file := query.Get("file"); file != historyConfig && file != historySubApplications {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	from, _ := strconv.Atoi(query.Get("from"))
+	to, _ := strconv.Atoi(query.Get("to"))
+	obj, err := diffHistory(query.Get("file"), from, to)
+	handleJsonAndError(w, obj, err)
+}
+
+// rollbackHistoryVersion applies a saved version of a file
+func rollbackHistoryVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	var request HistoryRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || (request.File != historyConfig && request.File != historySubApplications) {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	obj, err := rollbackHistory(request.File, request.Version, "api "+r.RemoteAddr)
+	if updateErr, ok := err.(*ConfigUpdateError); ok {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(updateErr)
+		return
+	}
+	handleJsonAndError(w, obj, err)
+}
+
 func apiStatus(w http.ResponseWriter, r *http.Request) {
 	status, err := apiStatusInternal()
 	handleJsonAndError(w, status, err)
@@ -216,6 +370,11 @@ func listApplications(w http.ResponseWriter, r *http.Request) {
 	handleJsonAndError(w, obj, nil)
 }
 
+// listStates returns the runtime state of every application, their definitions are at /applications
+func listStates(w http.ResponseWriter, r *http.Request) {
+	handleJsonAndError(w, listStatesInternal(), nil)
+}
+
 func listFlags(w http.ResponseWriter, r *http.Request) {
 	application := r.URL.Query().Get("application")
 
@@ -230,7 +389,7 @@ func applicationOperation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	decoder := json.NewDecoder(r.Body)
-	var data SubApplication
+	var data AppRequest
 	err := decoder.Decode(&data)
 	if err != nil {
 		http.Error(w, "Invalid request", http.StatusBadRequest)
@@ -238,7 +397,157 @@ func applicationOperation(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var operation string = r.Method
-	appStatus, err := appRequestHandlerInternal(data, operation)
+	appStatus, err := appRequestHandlerInternal(data, operation, "api "+r.RemoteAddr)
 
 	handleJsonAndError(w, appStatus, err)
 }
+
+// handlers for /apps/{id}/{resource}
+var appResourceHandlers = map[string]func(w http.ResponseWriter, r *http.Request, app *SubApplication){
+	"packages":     listAppPackages,
+	"nodes":        appNodes,
+	"rollback":     appRollback,
+	"kit":          appKitUpgrade,
+	"export":       appExport,
+	"requirements": appRequirements,
+	"state":        appState,
+}
+
+func appResource(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/apps/"), "/"), "/")
+	if len(parts) < 2 || parts[0] == "" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	handler, ok := appResourceHandlers[parts[1]]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var app = SubApplication{Id: parts[0]}
+	handler(w, r, &app)
+}
+
+func listAppPackages(w http.ResponseWriter, r *http.Request, app *SubApplication) {
+	obj, err := app.listPythonPackages()
+	handleJsonAndError(w, obj, err)
+}
+
+func appNodes(w http.ResponseWriter, r *http.Request, app *SubApplication) {
+	var request NodeRequest
+	if r.Method == "POST" {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	obj, err := app.nodeOperation(request)
+	handleJsonAndError(w, obj, err)
+}
+
+func appRollback(w http.ResponseWriter, r *http.Request, app *SubApplication) {
+	if r.Method != "POST" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	obj, err := app.rollback()
+	handleJsonAndError(w, obj, err)
+}
+
+// appKitUpgrade shows the pending kit upgrade of the application, POST applies it
+func appKitUpgrade(w http.ResponseWriter, r *http.Request, app *SubApplication) {
+	switch r.Method {
+	case "GET":
+		obj, err := app.getKitUpgrade()
+		handleJsonAndError(w, obj, err)
+	case "POST":
+		var request KitUpgradeRequest
+		if r.ContentLength != 0 {
+			err := json.NewDecoder(r.Body).Decode(&request)
+			if err != nil {
+				http.Error(w, "Invalid request", http.StatusBadRequest)
+				return
+			}
+		}
+		obj, err := app.applyKitUpgrade(request, "api "+r.RemoteAddr)
+		handleJsonAndError(w, obj, err)
+	default:
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	}
+}
+
+// appRequirements checks the requirements of the application against the host without installing
+func appRequirements(w http.ResponseWriter, r *http.Request, app *SubApplication) {
+	obj, err := app.requirementReport()
+	handleJsonAndError(w, obj, err)
+}
+
+func appState(w http.ResponseWriter, r *http.Request, app *SubApplication) {
+	obj, err := app.stateReport()
+	handleJsonAndError(w, obj, err)
+}
+
+// appExport returns the application as a kit entry, POST can write it into a local kit repository
+func appExport(w http.ResponseWriter, r *http.Request, app *SubApplication) {
+	var request KitExportRequest
+	if r.Method == "POST" {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+	} else if r.Method != "GET" {
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	obj, err := app.exportKit(request)
+	handleJsonAndError(w, obj, err)
+}
+
+// credentialsOperation lists, sets or deletes credentials, secrets are never returned
+func credentialsOperation(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleJsonAndError(w, listCredentials(), nil)
+	case "POST", "PUT":
+		var credential Credential
+		err := json.NewDecoder(r.Body).Decode(&credential)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		obj, err := setCredential(credential)
+		handleJsonAndError(w, obj, err)
+	case "DELETE":
+		obj, err := deleteCredential(r.URL.Query().Get("match"))
+		handleJsonAndError(w, obj, err)
+	default:
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	}
+}
+
+// secretsOperation lists the names of the secrets, POST or PUT sets one and DELETE removes the one named in ?name=
+func secretsOperation(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		handleJsonAndError(w, listSecrets(), nil)
+	case "POST", "PUT":
+		var secret Secret
+		err := json.NewDecoder(r.Body).Decode(&secret)
+		if err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		obj, err := setSecret(secret)
+		handleJsonAndError(w, obj, err)
+	case "DELETE":
+		obj, err := deleteSecret(r.URL.Query().Get("name"))
+		handleJsonAndError(w, obj, err)
+	default:
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+	}
+}
@@ -15,10 +15,11 @@ func makeError(msg string, err error) error {
 func apiStatusInternal() (*DeamonStatus, error) {
 	go broadcastToSocket("config", CurrentConfig)
 	go broadcastToSocket("subapplications", subApplications)
+	go listStatesInternal()
 	go listDiskSpaceInternal()
 	go getAllKits()
 
-	state := DeamonStatus{Name: serviceName, Config: CurrentConfig, SubApplications: subApplications}
+	state := DeamonStatus{Name: serviceName, Config: CurrentConfig, SubApplications: subApplications, States: getStates(subApplications)}
 
 	return &state, nil
 }
@@ -36,13 +37,14 @@ func listDiskSpaceInternal() ([]DiskSpace, error) {
 
 func listApplicationsInternal() ApplicationStatus {
 
-	state := ApplicationStatus{Status: status_app, SubApplications: subApplications}
+	state := ApplicationStatus{Status: status_app, SubApplications: subApplications, States: getStates(subApplications)}
 	defer broadcastToSocket("subapplications", subApplications)
 	return state
 
 }
 
-func appRequestHandlerInternal(changes SubApplication, operation string) (*ApplicationStatus, error) {
+func appRequestHandlerInternal(request AppRequest, operation string, actor string) (*ApplicationStatus, error) {
+	changes := request.SubApplication
 	mu.Lock()
 	defer mu.Unlock()
 
@@ -67,11 +69,14 @@ func appRequestHandlerInternal(changes SubApplication, operation string) (*Appli
 
 	switch operation {
 	case "post":
-		changes.add()
+		_, err := request.addApplication(actor)
+		if err != nil {
+			return nil, makeError("failed to add app", err)
+		}
 	case "put":
-		changes.modify()
+		changes.modify(actor)
 	case "delete":
-		changes.remove()
+		changes.remove(actor)
 	default:
 		return nil, makeError("invalid operation", nil)
 	}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// SubApplicationState is what the daemon knows about an application at runtime, as opposed to
+// its definition. It is kept in its own file, which isn't versioned.
+type SubApplicationState struct {
+	Running           bool                 `json:"running"`           // Indicates if the subprocess is running
+	Status            string               `json:"status"`            // Status of the subprocess
+	FirstRun          bool                 `json:"firstRun"`          // Indicates if the application is running for the first time
+	Installed         bool                 `json:"installed"`         // Indicates if the application is installed
+	HasUpdates        bool                 `json:"hasUpdates"`        // Indicates if the application has updates
+	AvailableUpdate   string               `json:"availableUpdate"`   // Tag or commit available on the update channel
+	FailedUpdate      string               `json:"failedUpdate"`      // Update that failed, not applied automatically again until the channel moves
+	UpdateHistory     []UpdateRecord       `json:"updateHistory"`     // Outcome of the last updates
+	ActiveSlot        string               `json:"activeSlot"`        // Blue/green slot the application runs from
+	SetupState        SetupState           `json:"setupState"`        // Status of each setup step, by name
+	StandbySetupState SetupState           `json:"standbySetupState"` // Status of each setup step in the blue/green standby slot
+	LastError         *SubApplicationError `json:"lastError"`         // Details of the last failed operation
+	PythonDrift       []string             `json:"pythonDrift"`       // Differences between the python environment and its snapshot
+	KitUpgrade        string               `json:"kitUpgrade"`        // Newer kit version available, "changed" if the kit has no version
+	RequirementReport *RequirementReport   `json:"requirementReport"` // Outcome of the last requirement checks
+}
+
+// AppState is the runtime state of an application as the API shows it
+type AppState struct {
+	Id string `json:"id"`
+	SubApplicationState
+}
+
+// getState returns the runtime state of the application
+func (subApp *SubApplication) getState() *AppState {
+	return &AppState{Id: subApp.Id, SubApplicationState: subApp.SubApplicationState}
+}
+
+// getStates returns the runtime state of every application
+func getStates(subApps []*SubApplication) []*AppState {
+	states := []*AppState{}
+	for _, subApp := range subApps {
+		states = append(states, subApp.getState())
+	}
+	return states
+}
+
+// listStatesInternal returns the runtime state of every application
+func listStatesInternal() []*AppState {
+	states := getStates(subApplications)
+	defer broadcastToSocket("appstates", states)
+	return states
+}
+
+// readSubApplicationStates restores the runtime state of the applications. Without a state file the
+// state is taken from the definitions, where older versions kept it. Nothing runs yet, whatever was saved.
+func readSubApplicationStates(subApps []*SubApplication, definitions []byte) {
+	content, err := getStateStore().Read(stateSubApplicationStates)
+	if os.IsNotExist(err) {
+		content = definitions
+	} else if err != nil {
+		logToMainFile(fmt.Sprintf("Error reading application states: %v", err))
+		return
+	}
+	var states []AppState
+	err = json.Unmarshal(content, &states)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error decoding application states: %v", err))
+		return
+	}
+	byId := make(map[string]SubApplicationState)
+	for _, state := range states {
+		byId[state.Id] = state.SubApplicationState
+	}
+	for _, subApp := range subApps {
+		if state, ok := byId[subApp.Id]; ok {
+			subApp.SubApplicationState = state
+		}
+		subApp.Running = false
+		subApp.Status = "Stopped"
+	}
+}
+
+// saveSubApplicationStates saves the runtime state of the applications
+func saveSubApplicationStates() {
+	states := getStates(subApplications)
+	content, err := json.MarshalIndent(states, "", "    ")
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error encoding application states: %v", err))
+		return
+	}
+	err = getStateStore().Write(stateSubApplicationStates, append(content, '\n'))
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error saving application states: %v", err))
+		return
+	}
+	broadcastToSocket("appstates", states)
+}
+
+// stateReport returns the runtime state of the application
+func (subAppDef *SubApplication) stateReport() (*AppState, error) {
+	subApp := subAppDef.getCurrent()
+	if subApp == nil {
+		return nil, fmt.Errorf("invalid app")
+	}
+	state := subApp.getState()
+	defer broadcastToSocket("appstate", state)
+	return state, nil
+}
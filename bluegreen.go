@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+)
+
+// the blue slot is the regular install location, the green slot a sibling checkout
+var blueSlot = "blue"
+var greenSlot = "green"
+
+// interval between two health check attempts of a candidate
+var healthCheckInterval = 2 * time.Second
+
+// BlueGreenConfig enables blue/green updates, where a new version is prepared and checked in a
+// second checkout before the application is switched to it
+type BlueGreenConfig struct {
+	SparePort     string `json:"sparePort"`     // Port the candidate is started on, defaults to the application port + 1
+	HealthCheck   string `json:"healthCheck"`   // Path that must answer 200, defaults to /system_stats for ComfyUI and / otherwise
+	HealthTimeout int    `json:"healthTimeout"` // Seconds the candidate has to become healthy, defaults to 120
+}
+
+// getInstallLocation returns the install location of the active slot of the application
+func getInstallLocation(subApp *SubApplication) (string, error) {
+	return subApp.getSlotLocation(subApp.getActiveSlot())
+}
+
+// getActiveSlot returns the slot the application runs from
+func (subApp *SubApplication) getActiveSlot() string {
+	if subApp.ActiveSlot == "" {
+		return blueSlot
+	}
+	return subApp.ActiveSlot
+}
+
+// getStandbySlot returns the slot not in use, where the next version is prepared
+func (subApp *SubApplication) getStandbySlot() string {
+	if subApp.getActiveSlot() == greenSlot {
+		return blueSlot
+	}
+	return greenSlot
+}
+
+// getSlotLocation returns the checkout used by a slot
+func (subApp *SubApplication) getSlotLocation(slot string) (string, error) {
+	base, err := getBaseInstallLocation(subApp)
+	if err != nil {
+		return "", err
+	}
+	if slot == greenSlot {
+		return base + "." + greenSlot, nil
+	}
+	return base, nil
+}
+
+// getHealthCheck returns the health check path of the candidate
+func (config *BlueGreenConfig) getHealthCheck(subApp *SubApplication) string {
+	if config.HealthCheck != "" {
+		return "/" + strings.TrimPrefix(config.HealthCheck, "/")
+	}
+	if subApp.supportsCustomNodes() {
+		return "/system_stats"
+	}
+	return "/"
+}
+
+// getSparePort returns the port the candidate is started on
+func (config *BlueGreenConfig) getSparePort(subApp *SubApplication) string {
+	if config.SparePort != "" {
+		return config.SparePort
+	}
+	port, err := strconv.Atoi(subApp.getPort())
+	if err != nil {
+		return defaultComfyPort
+	}
+	return strconv.Itoa(port + 1)
+}
+
+// blueGreenUpdate prepares the update in the standby slot, starts it on the spare port and
+// switches to it only if its health check passes. The live slot is left untouched otherwise.
+func (subApp *SubApplication) blueGreenUpdate(trigger string) bool {
+	liveLoc, err := getInstallLocation(subApp)
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Failed to get install location for subapplication %s: %v", subApp.Name, err), nil)
+		return false
+	}
+	live, err := git.PlainOpen(liveLoc)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Failed to open repository for subapplication %s: %v", subApp.Name, err))
+		return false
+	}
+	from := headCommit(live)
+	standbySlot := subApp.getStandbySlot()
+	standbyLoc, err := subApp.getSlotLocation(standbySlot)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Failed to get %s slot for subapplication %s: %v", standbySlot, subApp.Name, err))
+		return false
+	}
+
+	// the live version keeps running, only the status shows the update so isBusy sees it.
+	// Whether it runs is taken now, the switch restarts it from the new slot.
+	wasRunning := subApp.Running
+	status := subApp.Status
+	subApp.Status = "Updating"
+	notifySubApplicationsStatusChange()
+	defer func() {
+		if subApp.Status == "Updating" {
+			subApp.Status = status
+			notifySubApplicationsStatusChange()
+		}
+	}()
+
+	logToFile("log", fmt.Sprintf("Preparing update in the %s slot: %s", standbySlot, standbyLoc), subApp, true)
+	// the setup runs against the state of the standby slot, the live one keeps its own
+	subApp.swapSetupState()
+	standby, err := subApp.prepareStandby(standbyLoc)
+	to := ""
+	if standby != nil {
+		to = headCommit(standby)
+	}
+	if err == nil && to != from {
+		err = subApp.checkCandidate(standbyLoc)
+	}
+	subApp.swapSetupState()
+	if err == nil && to == from {
+		logToFile("log", "Standby slot is already at the live version, nothing to switch", subApp)
+		subApp.HasUpdates = false
+		subApp.AvailableUpdate = ""
+		return true
+	}
+	if err == nil {
+		subApp.HasUpdates = false
+		subApp.AvailableUpdate = ""
+		err = subApp.switchSlot(standbySlot, wasRunning)
+	}
+	subApp.recordUpdate(trigger, from, to, err)
+	if err != nil {
+		subApp.recordLastError("update", err, standbyLoc)
+		saveSubApplications()
+		return false
+	}
+	subApp.LastError = nil
+	saveSubApplications()
+	return true
+}
+
+// prepareStandby brings the standby checkout to the latest version of the update channel,
+// cloning it on first use
+func (subApp *SubApplication) prepareStandby(standbyLoc string) (*git.Repository, error) {
+	r, err := git.PlainOpen(standbyLoc)
+	if err != nil {
+		os.RemoveAll(standbyLoc)
+		subApp.SetupState = nil
+		err = subApp.installInto(standbyLoc, false)
+		if err != nil {
+			return nil, err
+		}
+		r, err = git.PlainOpen(standbyLoc)
+		if err != nil {
+			return nil, err
+		}
+	}
+	_, err = subApp.pullUpdate(r, standbyLoc)
+	if err != nil {
+		return r, err
+	}
+	subApp.restoreCustomNodes(standbyLoc)
+	return r, nil
+}
+
+// swapSetupState exchanges the setup state of the live slot with the one of the standby slot
+func (subApp *SubApplication) swapSetupState() {
+	subApp.SetupState, subApp.StandbySetupState = subApp.StandbySetupState, subApp.SetupState
+}
+
+// checkCandidate starts the application from dir on the spare port and waits for its health check
+func (subApp *SubApplication) checkCandidate(dir string) error {
+	config := subApp.BlueGreen
+	port := config.getSparePort(subApp)
+	timeout := time.Duration(config.HealthTimeout) * time.Second
+	if timeout == 0 {
+		timeout = 2 * time.Minute
+	}
+
+	command := subApp.Command
+	if len(subApp.Flags) > 0 {
+		command = fmt.Sprintf("%s %s", command, strings.Join(subApp.Flags, " "))
+	}
+	command, err := subApp.expandPlaceholders(command, dir)
+	if err != nil {
+		return err
+	}
+	command = setPortArg(command, port)
+	commandExec, err := subApp.expandPlaceholders(subApp.CommandExec, dir)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, commandExec)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true, CmdLine: command}
+	cmd.Dir = dir
+	output, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = cmd.Stdout
+	logToFile("log", fmt.Sprintf("Starting candidate on port %s: %s %s", port, commandExec, command), subApp)
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start candidate: %v", err)
+	}
+	subApp.clearRecentOutput()
+	go func() {
+		scanner := bufio.NewScanner(output)
+		for scanner.Scan() {
+			subApp.recordOutput(scanner.Text())
+			logToFile("console", "[candidate] "+scanner.Text(), subApp)
+		}
+	}()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	url := fmt.Sprintf("http://127.0.0.1:%s%s", port, config.getHealthCheck(subApp))
+	client := http.Client{Timeout: healthCheckInterval}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("candidate exited before becoming healthy: %v", err)
+		case <-time.After(healthCheckInterval):
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			logToFile("log", fmt.Sprintf("Candidate passed its health check on %s", url), subApp, true)
+			cancel()
+			<-exited
+			return nil
+		}
+	}
+	cancel()
+	<-exited
+	return fmt.Errorf("candidate failed its health check on %s within %v", url, timeout)
+}
+
+// setPortArg sets the --port argument of a command line, adding it if missing
+func setPortArg(command string, port string) string {
+	args := strings.Fields(command)
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--port=") {
+			args[i] = "--port=" + port
+			return strings.Join(args, " ")
+		}
+		if arg == "--port" && i+1 < len(args) {
+			args[i+1] = port
+			return strings.Join(args, " ")
+		}
+	}
+	return strings.TrimSpace(command + " --port " + port)
+}
+
+// switchSlot makes the application run from the given slot, restarting it if it was running
+// before the caller started working on the slots. The other slot is kept for rollbacks.
+func (subApp *SubApplication) switchSlot(slot string, wasRunning bool) error {
+	loc, err := subApp.getSlotLocation(slot)
+	if err != nil {
+		return err
+	}
+	if _, err := git.PlainOpen(loc); err != nil {
+		return fmt.Errorf("%s slot has no checkout: %v", slot, err)
+	}
+	if wasRunning {
+		subApp.stop()
+	}
+	logToFile("log", fmt.Sprintf("Switching from the %s slot to the %s slot", subApp.getActiveSlot(), slot), subApp, true)
+	if slot != subApp.getActiveSlot() {
+		subApp.swapSetupState()
+	}
+	subApp.ActiveSlot = slot
+	saveSubApplications()
+	broadcastToSocket("appstates", getStates(subApplications))
+	if wasRunning {
+		subApp.start()
+	}
+	return nil
+}
+
+// rollback switches back to the slot that was live before the last switch
+func (subAppDef *SubApplication) rollback() (*SubApplication, error) {
+	subApp := subAppDef.getCurrent()
+	if subApp == nil {
+		return nil, fmt.Errorf("invalid app")
+	}
+	if subApp.BlueGreen == nil {
+		return nil, fmt.Errorf("application %s doesn't use blue/green updates", subApp.Name)
+	}
+	liveLoc, err := getInstallLocation(subApp)
+	if err != nil {
+		return nil, err
+	}
+	previousLoc, err := subApp.getSlotLocation(subApp.getStandbySlot())
+	if err != nil {
+		return nil, err
+	}
+	from, to := "", ""
+	if r, err := git.PlainOpen(liveLoc); err == nil {
+		from = headCommit(r)
+	}
+	if r, err := git.PlainOpen(previousLoc); err == nil {
+		to = headCommit(r)
+	}
+	err = subApp.switchSlot(subApp.getStandbySlot(), subApp.Running)
+	subApp.recordUpdate("rollback", from, to, err)
+	if err != nil {
+		return nil, err
+	}
+	return subApp, nil
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// file, inside the data folder, where the kit catalog is cached between restarts
+var kitCatalogFile = "kitcatalog.json"
+
+// failing sources are not tried again before this interval
+var kitRetryInterval = 5 * time.Minute
+
+// KitCatalog is the merged list of kits and the state of each kit source
+type KitCatalog struct {
+	Kits    []Kit              `json:"kits"`
+	Sources []KitCatalogSource `json:"sources"`
+}
+
+// KitCatalogSource reports the cache state of a kit source
+type KitCatalogSource struct {
+	Type       string `json:"type"`
+	Location   string `json:"location"`
+	Kits       int    `json:"kits"`       // Number of kits listed by the source
+	Invalid    int    `json:"invalid"`    // Number of kits that failed validation
+	FetchedAt  string `json:"fetchedAt"`  // Last successful fetch or revalidation
+	StaleSince string `json:"staleSince"` // Set while the source fails, since the first failure
+	RetryAfter string `json:"retryAfter"` // Set while the source is rate limited
+	Trust      string `json:"trust"`      // Whether the kit list is verified, unsigned or invalid
+	SignedBy   string `json:"signedBy"`   // Trusted key that signed the kit list
+	Error      string `json:"error"`      // Last error of the source
+}
+
+// kitCacheEntry is the cached kit list of a source
+type kitCacheEntry struct {
+	Kits         []Kit     `json:"kits"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+	AttemptedAt  time.Time `json:"attemptedAt"`
+	ETag         string    `json:"etag"`
+	LastModified string    `json:"lastModified"`
+	ListHash     string    `json:"listHash"` // Hash of the kit list the trust state was checked for
+	RetryAfter   time.Time `json:"retryAfter"`
+	StaleSince   time.Time `json:"staleSince"`
+	Error        string    `json:"error"`
+	Trust        string    `json:"trust"`
+	SignedBy     string    `json:"signedBy"`
+}
+
+var kitCache map[string]*kitCacheEntry
+var kitCacheMu sync.Mutex
+
+// kit lists being fetched, by cache key, so a source is only fetched once at a time
+var kitFetches = make(map[string]chan struct{})
+
+// getKitCatalogTTL returns how long a kit list is used before it is revalidated
+func getKitCatalogTTL() time.Duration {
+	ttl := CurrentConfig.KitCatalogTTL
+	if ttl == 0 {
+		ttl = 60
+	}
+	return time.Duration(ttl) * time.Minute
+}
+
+// getKitRepositories returns the main kit repository followed by the configured ones
+func getKitRepositories() []KitRepository {
+	return append([]KitRepository{mainAppKitRepository}, CurrentConfig.AppKitRepositories...)
+}
+
+// getCacheKey identifies the source in the cache
+func (repo KitRepository) getCacheKey() string {
+	// trusted keys are part of the key so changing them verifies the list again
+	return repo.getType() + "|" + repo.Location + "|" + repo.Ref + "|" + strings.Join(repo.TrustedKeys, ",")
+}
+
+// getAllKits gets all kits from all kit repositories, from the cache when it is fresh enough
+func getAllKits() []Kit {
+	return searchKits(KitQuery{})
+}
+
+// getKitCatalog returns the merged kits and the state of each source.
+// force revalidates every source that isn't rate limited, even if its cache is fresh.
+func getKitCatalog(force bool) KitCatalog {
+	kitCacheMu.Lock()
+	if kitCache == nil {
+		kitCache = readKitCache()
+	}
+	kitCacheMu.Unlock()
+	repos := getKitRepositories()
+	changed := false
+	for _, repo := range repos {
+		changed = refreshKitSource(repo, force) || changed
+	}
+
+	kitCacheMu.Lock()
+	defer kitCacheMu.Unlock()
+	catalog := KitCatalog{Kits: []Kit{}, Sources: []KitCatalogSource{}}
+	for _, repo := range repos {
+		entry := kitCache[repo.getCacheKey()]
+		if entry == nil {
+			entry = &kitCacheEntry{}
+		}
+		for _, k := range entry.Kits {
+			found := false
+			for _, kit := range catalog.Kits {
+				if k.Id != "" && kit.Id == k.Id {
+					found = true
+					break
+				}
+			}
+			if !found {
+				catalog.Kits = append(catalog.Kits, k.applyTrustPolicy())
+			}
+		}
+		catalog.Sources = append(catalog.Sources, entry.getSourceState(repo))
+	}
+	if changed {
+		writeKitCache()
+	}
+	return catalog
+}
+
+// refreshKitSource fetches the kit list of the source again if its cache entry expired, and
+// reports whether the entry changed. Failed fetches keep the previous kits and mark them stale.
+// The cache isn't locked during the fetch, a caller asking for a source being fetched waits for it.
+func refreshKitSource(repo KitRepository, force bool) bool {
+	key := repo.getCacheKey()
+	kitCacheMu.Lock()
+	if fetching, ok := kitFetches[key]; ok {
+		kitCacheMu.Unlock()
+		<-fetching
+		return false
+	}
+	entry := kitCache[key]
+	if entry == nil {
+		entry = &kitCacheEntry{}
+		kitCache[key] = entry
+	}
+	now := time.Now()
+	if (!force && entry.Error == "" && now.Sub(entry.FetchedAt) < getKitCatalogTTL()) ||
+		(!force && entry.Error != "" && now.Sub(entry.AttemptedAt) < kitRetryInterval) {
+		kitCacheMu.Unlock()
+		return false
+	}
+	if now.Before(entry.RetryAfter) {
+		if entry.StaleSince.IsZero() {
+			entry.StaleSince = now
+		}
+		entry.Error = fmt.Sprintf("rate limited until %s", entry.RetryAfter.Format(time.RFC3339))
+		kitCacheMu.Unlock()
+		return false
+	}
+	entry.AttemptedAt = now
+	validators := kitValidators{ETag: entry.ETag, LastModified: entry.LastModified}
+	listHash, trust, signedBy := entry.ListHash, entry.Trust, entry.SignedBy
+	checkTrust := kitTrustNeedsCheck(repo, trust, signedBy)
+	if checkTrust {
+		// the list is needed to check a signature against, even if it didn't change
+		validators = kitValidators{}
+	}
+	fetching := make(chan struct{})
+	kitFetches[key] = fetching
+	kitCacheMu.Unlock()
+
+	content, err := readKitList(repo, &validators)
+	var kits []Kit
+	if err != nil && err != errNotModified {
+		logToMainFile(fmt.Sprintf("Failed to get kits list from %s, serving the cached one: %v", repo.Location, err))
+	} else if err == nil {
+		kits, err = parseKitList(content, repo.Location)
+		if err != nil {
+			logToMainFile(fmt.Sprintf("Failed to get kits list from %s, serving the cached one: %v", repo.Location, err))
+		} else if sum := sha256.Sum256(content); hex.EncodeToString(sum[:]) != listHash || checkTrust {
+			// the signature is only fetched again when the list changed or its trust may have,
+			// sources without conditional requests return the same list on every refresh
+			listHash = hex.EncodeToString(sum[:])
+			trust, signedBy = verifyKitList(repo, content, readKitSignature(repo))
+		}
+	}
+
+	kitCacheMu.Lock()
+	defer kitCacheMu.Unlock()
+	delete(kitFetches, key)
+	defer close(fetching)
+	entry.RetryAfter = validators.RetryAfter
+	if err == errNotModified {
+		entry.FetchedAt = now
+		entry.StaleSince = time.Time{}
+		entry.Error = ""
+		return true
+	}
+	if err != nil {
+		if entry.StaleSince.IsZero() {
+			entry.StaleSince = now
+		}
+		entry.Error = err.Error()
+		return true
+	}
+	entry.Trust, entry.SignedBy, entry.ListHash = trust, signedBy, listHash
+	for i := range kits {
+		kits[i].Trust = entry.Trust
+	}
+	entry.Kits = kits
+	entry.ETag = validators.ETag
+	entry.LastModified = validators.LastModified
+	entry.FetchedAt = now
+	entry.StaleSince = time.Time{}
+	entry.Error = ""
+	return true
+}
+
+// readKitList reads the kit list of a repository, conditionally if the source supports it
+func readKitList(repo KitRepository, validators *kitValidators) ([]byte, error) {
+	source, err := newKitSource(repo)
+	if err != nil {
+		return nil, err
+	}
+	if conditional, ok := source.(conditionalKitSource); ok {
+		return conditional.ReadFileConditional(kitListFile, validators)
+	}
+	return source.ReadFile(kitListFile)
+}
+
+// getSourceState returns what the catalog reports about the source
+func (entry *kitCacheEntry) getSourceState(repo KitRepository) KitCatalogSource {
+	state := KitCatalogSource{
+		Type:     repo.getType(),
+		Location: repo.Location,
+		Kits:     len(entry.Kits),
+		Error:    entry.Error,
+		Trust:    entry.Trust,
+		SignedBy: entry.SignedBy,
+	}
+	for _, kit := range entry.Kits {
+		if !kit.applyTrustPolicy().isValid() {
+			state.Invalid++
+		}
+	}
+	if !entry.FetchedAt.IsZero() {
+		state.FetchedAt = entry.FetchedAt.Format(time.RFC3339)
+	}
+	if !entry.StaleSince.IsZero() {
+		state.StaleSince = entry.StaleSince.Format(time.RFC3339)
+	}
+	if time.Now().Before(entry.RetryAfter) {
+		state.RetryAfter = entry.RetryAfter.Format(time.RFC3339)
+	}
+	return state
+}
+
+// readKitCache loads the cached kit lists, an unreadable cache is started over
+func readKitCache() map[string]*kitCacheEntry {
+	cache := make(map[string]*kitCacheEntry)
+	content, err := getStateStore().Read(stateKitCatalog)
+	if err != nil {
+		return cache
+	}
+	err = json.Unmarshal(content, &cache)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error decoding kit catalog cache: %v", err))
+		return make(map[string]*kitCacheEntry)
+	}
+	// the cache may predate validation rules, check the kits again
+	for _, entry := range cache {
+		for i := range entry.Kits {
+			entry.Kits[i].RepoURL = expandRemote(entry.Kits[i].RepoURL)
+			entry.Kits[i].Errors = entry.Kits[i].validate()
+		}
+	}
+	return cache
+}
+
+// writeKitCache saves the cached kit lists so restarts don't fetch them again
+func writeKitCache() {
+	content, err := json.Marshal(kitCache)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error encoding kit catalog cache: %v", err))
+		return
+	}
+	err = getStateStore().Write(stateKitCatalog, content)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error creating kit catalog cache: %v", err))
+	}
+}
@@ -5,119 +5,124 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"strconv"
 )
 
 var configFile = "config.json"
 
-var mainAppKitRepository = "https://github.com/RazvanManolache/Mr.G-Daemon-Kits-List"
+var mainAppKitRepository = KitRepository{Type: "github", Location: "https://github.com/RazvanManolache/Mr.G-Daemon-Kits-List"}
 
 var CurrentConfig Config
 
 type Config struct {
-	CheckDisksInterval                 int      `json:"checkDisksInterval"`
-	CheckSubApplicationsInterval       int      `json:"checkSubApplicationsInterval"`
-	CheckSubApplicationsUpdateInterval int      `json:"checkSubApplicationsUpdateInterval"`
-	ApplicationFolder                  string   `json:"applicationFolder"`
-	LogFolder                          string   `json:"logFolder"`
-	DataFolder                         string   `json:"dataFolder"`
-	AppKitRepositories                 []string `json:"appKitRepositories"`
+	CheckDisksInterval                 int             `json:"checkDisksInterval"`
+	CheckSubApplicationsInterval       int             `json:"checkSubApplicationsInterval"`
+	CheckSubApplicationsUpdateInterval int             `json:"checkSubApplicationsUpdateInterval"`
+	ApplicationFolder                  string          `json:"applicationFolder"`
+	LogFolder                          string          `json:"logFolder"`
+	DataFolder                         string          `json:"dataFolder"`
+	AppKitRepositories                 []KitRepository `json:"appKitRepositories"`
+	PythonInterpreter                  string          `json:"pythonInterpreter"`
+	DisableMirrorCache                 bool            `json:"disableMirrorCache"`
+	KitCatalogTTL                      int             `json:"kitCatalogTTL"`
+	KitTrustPolicy                     string          `json:"kitTrustPolicy"`
+	KitRequirementPolicy               string          `json:"kitRequirementPolicy"`
+	ListenAddress                      string          `json:"listenAddress"`
+	ListenAddresses                    []string        `json:"listenAddresses"` // Additional addresses the API listens on
+	TLSCertFile                        string          `json:"tlsCertFile"`     // Certificate the API is served with over HTTPS
+	TLSKeyFile                         string          `json:"tlsKeyFile"`      // Private key of the certificate
+	TLSSelfSigned                      bool            `json:"tlsSelfSigned"`   // Serves HTTPS with a certificate generated on first run when none is set
+	ControlSocket                      string          `json:"controlSocket"`   // Unix domain socket for local control, relative to the daemon
+	SecretsKeyFile                     string          `json:"secretsKeyFile"`  // File holding the key of the secrets file, used when MRG_SECRETS_KEY isn't set
 }
 
+// getConfigFile returns the config file, given on the command line, in MRG_CONFIG or next to the executable
 func getConfigFile() (string, error) {
+	if configFilePath != "" && filepath.IsAbs(configFilePath) {
+		return configFilePath, nil
+	}
 	runningPath, err := getCurrentPath()
 	if err != nil {
 		logToMainFile(fmt.Sprintf("Error getting running path: %v", err))
 		return "", nil
 	}
+	if configFilePath != "" {
+		return filepath.Join(runningPath, configFilePath), nil
+	}
 	fullPath := filepath.Join(runningPath, configFile)
 	return fullPath, nil
 }
 
-func readConfigFile() (*Config, error) {
-	configFilePath, err := getConfigFile()
-	if err != nil {
+// loadConfig builds the configuration from its layers without notifying clients
+func loadConfig() (*Config, error) {
+	content, err := getStateStore().Read(stateConfig)
+	if err != nil && !os.IsNotExist(err) {
 		logToMainFile(fmt.Sprintf("Error opening config file: %v", err))
 		return nil, err
 	}
+	if os.IsNotExist(err) {
+		path, _ := getConfigFile()
+		logToMainFile(fmt.Sprintf("Config file %s not found, using defaults", path))
+	}
 
-	configFile, err := os.Open(configFilePath)
-
+	config, sources, overrides, err := layerConfig(content)
 	if err != nil {
-		logToMainFile(fmt.Sprintf("Error opening config file: %v", err))
+		logToMainFile(fmt.Sprintf("Error decoding config file: %v", err))
 		return nil, err
-
-	} else {
-		err = json.NewDecoder(configFile).Decode(&CurrentConfig)
-		if err != nil {
-			logToMainFile(fmt.Sprintf("Error decoding config file: %v", err))
-			return nil, err
-		}
 	}
-
-	defer configFile.Close()
-	defer broadcastToSocket("config", CurrentConfig)
+	CurrentConfig = config
+	configSources = sources
+	configOverrides = overrides
+	configFileFields, _ = readConfigFileFields(content)
 	return &CurrentConfig, nil
 }
 
-func writeConfigFile() (*Config, error) {
-	configFilePath, err := getConfigFile()
-	if err != nil {
-		logToMainFile(fmt.Sprintf("Error opening config file: %v", err))
-		return nil, err
+// loadDefaultConfig uses the defaults, with the environment and the command line applied, when
+// the config file can't be used. Fixing the file reloads it.
+func loadDefaultConfig() {
+	config, sources, overrides, _ := layerConfig(nil)
+	CurrentConfig = config
+	configSources = sources
+	configOverrides = overrides
+	configFileFields = make(map[string]json.RawMessage)
+}
+
+// readConfigFileFields returns the fields present in the content of the config file
+func readConfigFileFields(content []byte) (map[string]json.RawMessage, error) {
+	fields := make(map[string]json.RawMessage)
+	if len(content) == 0 {
+		return fields, nil
 	}
-	configFile, err := os.Create(configFilePath)
+	err := json.Unmarshal(content, &fields)
+	return fields, err
+}
 
+func readConfigFile() (*Config, error) {
+	config, err := loadConfig()
 	if err != nil {
-		logToMainFile(fmt.Sprintf("Error creating config file: %v", err))
 		return nil, err
-	} else {
-		err = json.NewEncoder(configFile).Encode(CurrentConfig)
-		if err != nil {
-			logToMainFile(fmt.Sprintf("Error encoding config file: %v", err))
-			return nil, err
-		}
 	}
-
-	defer configFile.Close()
-	return readConfigFile()
+	defer broadcastToSocket("config", CurrentConfig)
+	return config, nil
 }
 
-func updateConfigFile(data map[string]string) (*Config, error) {
-
-	if data != nil {
-
-		for key, value := range data {
-			switch key {
-			case "checkDisksInterval":
-				intValue, err := strconv.Atoi(value)
-				if err == nil {
-					CurrentConfig.CheckDisksInterval = intValue
-				}
-
-			case "checkSubApplicationsInterval":
-				intValue, err := strconv.Atoi(value)
-				if err == nil {
-					CurrentConfig.CheckSubApplicationsInterval = intValue
-				}
-
-			case "checkSubApplicationsUpdateInterval":
-				intValue, err := strconv.Atoi(value)
-				if err == nil {
-					CurrentConfig.CheckSubApplicationsUpdateInterval = intValue
-				}
-			case "applicationFolder":
-				CurrentConfig.ApplicationFolder = value
-			case "logFolder":
-				CurrentConfig.LogFolder = value
-			case "dataFolder":
-				CurrentConfig.DataFolder = value
-			}
-
-		}
+// writeConfigFile saves the configuration, values coming from the environment or the command
+// line are not written to the file
+func writeConfigFile() (*Config, error) {
+	return writeConfigFileAs("daemon", "")
+}
 
-		return writeConfigFile()
+// writeConfigFileAs saves the configuration and keeps it as a version, recording who changed it and why
+func writeConfigFileAs(actor string, reason string) (*Config, error) {
+	var previous, content []byte
+	err := getStateStore().Update(stateConfig, func(stored []byte) ([]byte, error) {
+		encoded, err := json.Marshal(getFileConfig())
+		previous, content = stored, encoded
+		return append(encoded, '\n'), err
+	})
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error saving config file: %v", err))
+		return nil, err
 	}
-
-	return &CurrentConfig, nil
+	recordVersion(historyConfig, content, previous, actor, reason)
+	return readConfigFile()
 }
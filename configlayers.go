@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// layers the configuration is built from, each one overriding the previous
+const (
+	configLayerDefault = "default"
+	configLayerFile    = "file"
+	configLayerEnv     = "env"
+	configLayerFlag    = "flag"
+)
+
+// prefix of the environment variables overriding the configuration, e.g. MRG_LISTEN_ADDRESS
+var configEnvPrefix = "MRG_"
+
+var configFilePath string                       // Config file given on the command line or in MRG_CONFIG
+var configFlagValues = make(map[string]string)  // Configuration values given on the command line, by JSON name
+var configSources = make(map[string]string)     // Layer each configuration value comes from, by JSON name
+var configOverrides map[string]json.RawMessage  // Values set by the environment or the command line
+var configFileFields map[string]json.RawMessage // Fields present in the config file
+
+// EffectiveConfig is the configuration in use and the layer each value comes from
+type EffectiveConfig struct {
+	Config  Config            `json:"config"`
+	Sources map[string]string `json:"sources"` // default, file, env or flag, by field
+	File    string            `json:"file"`    // Config file that was read
+}
+
+// getDefaultConfig returns the configuration used when nothing else is set
+func getDefaultConfig() Config {
+	return Config{
+		CheckDisksInterval:                 60,
+		CheckSubApplicationsInterval:       10,
+		CheckSubApplicationsUpdateInterval: 1440,
+		DataFolder:                         "data",
+		KitCatalogTTL:                      60,
+		KitTrustPolicy:                     "flag",
+		KitRequirementPolicy:               "refuse",
+		ListenAddress:                      ":8180",
+	}
+}
+
+// parseCommandLine reads --name=value and --name value options, named after the configuration
+// fields in kebab case, e.g. --listen-address. --config sets the config file.
+func parseCommandLine(args []string) {
+	names := make(map[string]string)
+	fieldType := reflect.TypeOf(Config{})
+	for i := 0; i < fieldType.NumField(); i++ {
+		name := getConfigFieldName(fieldType.Field(i))
+		names[toSeparated(name, "-", false)] = name
+	}
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			continue
+		}
+		option := strings.TrimPrefix(args[i], "--")
+		value := ""
+		if parts := strings.SplitN(option, "=", 2); len(parts) == 2 {
+			option, value = parts[0], parts[1]
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			value = args[i+1]
+			i++
+		}
+		if option == "config" {
+			configFilePath = value
+			continue
+		}
+		name, ok := names[option]
+		if !ok {
+			logToMainFile(fmt.Sprintf("Unknown command line option --%s", option))
+			continue
+		}
+		configFlagValues[name] = value
+	}
+	if configFilePath == "" {
+		configFilePath = os.Getenv(configEnvPrefix + "CONFIG")
+	}
+}
+
+// layerConfig builds the configuration from the defaults, the content of the config file,
+// the MRG_* environment variables and the command line, recording where each value came from
+func layerConfig(content []byte) (Config, map[string]string, map[string]json.RawMessage, error) {
+	config := getDefaultConfig()
+	sources := make(map[string]string)
+	overrides := make(map[string]json.RawMessage)
+	fileFields := make(map[string]json.RawMessage)
+	if len(strings.TrimSpace(string(content))) > 0 {
+		err := json.Unmarshal(content, &fileFields)
+		if err != nil {
+			return config, nil, nil, err
+		}
+	}
+
+	value := reflect.ValueOf(&config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		name := getConfigFieldName(value.Type().Field(i))
+		sources[name] = configLayerDefault
+		if raw, ok := fileFields[name]; ok && string(raw) != "null" {
+			parsed := reflect.New(field.Type())
+			err := json.Unmarshal(raw, parsed.Interface())
+			if err != nil {
+				return config, nil, nil, fmt.Errorf("%s: %v", name, err)
+			}
+			field.Set(parsed.Elem())
+			sources[name] = configLayerFile
+		}
+		layers := []struct {
+			layer string
+			label string
+			text  string
+			set   bool
+		}{
+			{layer: configLayerEnv, label: configEnvPrefix + toSeparated(name, "_", true)},
+			{layer: configLayerFlag, label: "--" + toSeparated(name, "-", false)},
+		}
+		layers[0].text, layers[0].set = os.LookupEnv(layers[0].label)
+		layers[1].text, layers[1].set = configFlagValues[name]
+		for _, layer := range layers {
+			if !layer.set {
+				continue
+			}
+			parsed, err := parseConfigValue(field.Type(), layer.text)
+			if err != nil {
+				logToMainFile(fmt.Sprintf("Ignoring %s: %v", layer.label, err))
+				continue
+			}
+			field.Set(parsed)
+			sources[name] = layer.layer
+			overrides[name], _ = json.Marshal(parsed.Interface())
+		}
+	}
+	return config, sources, overrides, nil
+}
+
+// getFileConfig returns the fields of the configuration that belong in the config file: values
+// set by the environment or the command line are left as they were in the file, defaults that
+// were never written stay out of it
+func getFileConfig() map[string]json.RawMessage {
+	fields := make(map[string]json.RawMessage)
+	defaults := reflect.ValueOf(getDefaultConfig())
+	value := reflect.ValueOf(CurrentConfig)
+	for i := 0; i < value.NumField(); i++ {
+		name := getConfigFieldName(value.Type().Field(i))
+		encoded, err := json.Marshal(value.Field(i).Interface())
+		if err != nil {
+			continue
+		}
+		fileValue, inFile := configFileFields[name]
+		if override, ok := configOverrides[name]; ok && string(override) == string(encoded) {
+			if inFile {
+				fields[name] = fileValue
+			}
+			continue
+		}
+		if !inFile && reflect.DeepEqual(value.Field(i).Interface(), defaults.Field(i).Interface()) {
+			continue
+		}
+		fields[name] = encoded
+	}
+	return fields
+}
+
+// parseConfigValue converts a value from the environment or the command line to the type of the field.
+// Lists are JSON or comma separated.
+func parseConfigValue(fieldType reflect.Type, text string) (reflect.Value, error) {
+	parsed := reflect.New(fieldType).Elem()
+	switch fieldType.Kind() {
+	case reflect.Int:
+		number, err := strconv.Atoi(strings.TrimSpace(text))
+		if err != nil {
+			return parsed, fmt.Errorf("%s is not a number", text)
+		}
+		parsed.SetInt(int64(number))
+	case reflect.Bool:
+		if text == "" {
+			text = "true"
+		}
+		flag, err := strconv.ParseBool(strings.TrimSpace(text))
+		if err != nil {
+			return parsed, fmt.Errorf("%s is not true or false", text)
+		}
+		parsed.SetBool(flag)
+	case reflect.String:
+		parsed.SetString(text)
+	case reflect.Slice:
+		content := []byte(text)
+		if !strings.HasPrefix(strings.TrimSpace(text), "[") {
+			items := []string{}
+			for _, item := range strings.Split(text, ",") {
+				if strings.TrimSpace(item) != "" {
+					items = append(items, strings.TrimSpace(item))
+				}
+			}
+			content, _ = json.Marshal(items)
+		}
+		pointer := reflect.New(fieldType)
+		err := json.Unmarshal(content, pointer.Interface())
+		if err != nil {
+			return parsed, fmt.Errorf("%s is not a valid list: %v", text, err)
+		}
+		parsed.Set(pointer.Elem())
+	default:
+		return parsed, fmt.Errorf("unsupported type %s", fieldType.Kind())
+	}
+	return parsed, nil
+}
+
+func getConfigFieldName(field reflect.StructField) string {
+	return strings.Split(field.Tag.Get("json"), ",")[0]
+}
+
+// toSeparated converts a camel case name, e.g. kitCatalogTTL to kit-catalog-ttl or KIT_CATALOG_TTL
+func toSeparated(name string, separator string, upper bool) string {
+	runes := []rune(name)
+	var builder strings.Builder
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previousLower := unicode.IsLower(runes[i-1])
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if previousLower || (nextLower && unicode.IsUpper(runes[i-1])) {
+				builder.WriteString(separator)
+			}
+		}
+		builder.WriteRune(r)
+	}
+	if upper {
+		return strings.ToUpper(builder.String())
+	}
+	return strings.ToLower(builder.String())
+}
+
+// getEffectiveConfig returns the configuration in use with the layer of each value
+func getEffectiveConfig() EffectiveConfig {
+	path, _ := getConfigFile()
+	sources := make(map[string]string)
+	for name, layer := range configSources {
+		sources[name] = layer
+	}
+	effective := EffectiveConfig{Config: CurrentConfig, Sources: sources, File: path}
+	defer broadcastToSocket("configeffective", effective)
+	return effective
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		name      string
+		fieldType reflect.Type
+		text      string
+		expected  interface{}
+		valid     bool
+	}{
+		{"number", reflect.TypeOf(0), "42", 42, true},
+		{"number with spaces", reflect.TypeOf(0), " 7 ", 7, true},
+		{"not a number", reflect.TypeOf(0), "seven", nil, false},
+		{"boolean", reflect.TypeOf(false), "false", false, true},
+		{"flag without value", reflect.TypeOf(false), "", true, true},
+		{"not a boolean", reflect.TypeOf(false), "maybe", nil, false},
+		{"string", reflect.TypeOf(""), "C:\\apps", "C:\\apps", true},
+		{"comma separated list", reflect.TypeOf([]string{}), "a, b,,c", []string{"a", "b", "c"}, true},
+		{"JSON list", reflect.TypeOf([]string{}), `["a,b", "c"]`, []string{"a,b", "c"}, true},
+		{"invalid JSON list", reflect.TypeOf([]string{}), `["a"`, nil, false},
+		{"JSON list of objects", reflect.TypeOf([]KitRepository{}), `[{"type": "local", "location": "kits"}]`, []KitRepository{{Type: "local", Location: "kits"}}, true},
+		{"unsupported type", reflect.TypeOf(1.5), "1.5", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseConfigValue(test.fieldType, test.text)
+			if !test.valid {
+				if err == nil {
+					t.Errorf("parseConfigValue(%q) = %v, expected an error", test.text, parsed.Interface())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseConfigValue(%q) failed: %v", test.text, err)
+			}
+			if !reflect.DeepEqual(parsed.Interface(), test.expected) {
+				t.Errorf("parseConfigValue(%q) = %#v, expected %#v", test.text, parsed.Interface(), test.expected)
+			}
+		})
+	}
+}
+
+func TestToSeparated(t *testing.T) {
+	tests := []struct {
+		name      string
+		separator string
+		upper     bool
+		expected  string
+	}{
+		{"listenAddress", "-", false, "listen-address"},
+		{"listenAddress", "_", true, "LISTEN_ADDRESS"},
+		{"kitCatalogTTL", "-", false, "kit-catalog-ttl"},
+		{"tlsCertFile", "_", true, "TLS_CERT_FILE"},
+		{"checkSubApplicationsUpdateInterval", "-", false, "check-sub-applications-update-interval"},
+		{"disableMirrorCache", "-", false, "disable-mirror-cache"},
+		{"dataFolder", "", false, "datafolder"},
+		{"port", "-", false, "port"},
+	}
+	for _, test := range tests {
+		if separated := toSeparated(test.name, test.separator, test.upper); separated != test.expected {
+			t.Errorf("toSeparated(%q, %q, %v) = %q, expected %q", test.name, test.separator, test.upper, separated, test.expected)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// configMu serializes changes to the configuration, from the API and from the file
+var configMu sync.Mutex
+
+// ConfigFieldError is a field of a configuration update that was rejected
+type ConfigFieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ConfigUpdateError lists every rejected field of a configuration update, nothing is saved
+type ConfigUpdateError struct {
+	Errors []ConfigFieldError `json:"errors"`
+}
+
+func (err *ConfigUpdateError) Error() string {
+	messages := []string{}
+	for _, fieldErr := range err.Errors {
+		messages = append(messages, fieldErr.Field+": "+fieldErr.Message)
+	}
+	return "invalid configuration: " + strings.Join(messages, "; ")
+}
+
+// patchConfig applies a JSON merge patch to the configuration. Fields are typed, null resets a
+// field to its default and lists are replaced. The patched configuration is validated and only
+// saved if every field is valid.
+func patchConfig(patch json.RawMessage, actor string) (*Config, error) {
+	return patchConfigAs(patch, actor, "")
+}
+
+// patchConfigAs applies a JSON merge patch, recording why the configuration changed.
+// Fields set by the environment or the command line are rejected, the file value wouldn't be used.
+func patchConfigAs(patch json.RawMessage, actor string, reason string) (*Config, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(patch, &fields)
+	if err != nil {
+		return nil, &ConfigUpdateError{Errors: []ConfigFieldError{{Field: "", Message: "the update must be a JSON object"}}}
+	}
+
+	candidate, err := copyConfig(CurrentConfig)
+	if err != nil {
+		return nil, err
+	}
+	errors := []ConfigFieldError{}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		field, ok := getConfigField(&candidate, name)
+		if !ok {
+			errors = append(errors, ConfigFieldError{Field: name, Message: "unknown field"})
+			continue
+		}
+		if message := getOverrideMessage(name); message != "" {
+			errors = append(errors, ConfigFieldError{Field: name, Message: message})
+			continue
+		}
+		if string(fields[name]) == "null" {
+			defaults := getDefaultConfig()
+			defaultField, _ := getConfigField(&defaults, name)
+			field.Set(defaultField)
+			continue
+		}
+		value := reflect.New(field.Type())
+		err := json.Unmarshal(fields[name], value.Interface())
+		if err != nil {
+			errors = append(errors, ConfigFieldError{Field: name, Message: fmt.Sprintf("expected a value of type %s", describeConfigType(field.Type()))})
+			continue
+		}
+		field.Set(value.Elem())
+		if message := validateConfigField(&candidate, name); message != "" {
+			errors = append(errors, ConfigFieldError{Field: name, Message: message})
+		}
+	}
+	if len(errors) > 0 {
+		logToMainFile(fmt.Sprintf("Rejected configuration update: %v", (&ConfigUpdateError{Errors: errors}).Error()))
+		return nil, &ConfigUpdateError{Errors: errors}
+	}
+
+	previous := CurrentConfig
+	CurrentConfig = candidate
+	config, err := writeConfigFileAs(actor, reason)
+	if err != nil {
+		CurrentConfig = previous
+		return nil, err
+	}
+	if fields := getRestartRequired(); len(fields) > 0 {
+		logToMainFile(fmt.Sprintf("Changes to %s take effect after a restart", strings.Join(fields, ", ")))
+		broadcastToSocket("restartrequired", fields)
+	}
+	return config, nil
+}
+
+// getOverrideMessage explains why a field set by the environment or the command line can't be changed
+func getOverrideMessage(name string) string {
+	switch configSources[name] {
+	case configLayerEnv:
+		return fmt.Sprintf("set by %s%s, a change would have no effect", configEnvPrefix, toSeparated(name, "_", true))
+	case configLayerFlag:
+		return fmt.Sprintf("set by --%s on the command line, a change would have no effect", toSeparated(name, "-", false))
+	}
+	return ""
+}
+
+// copyConfig returns a deep copy of the configuration, so a rejected update leaves it untouched
+func copyConfig(config Config) (Config, error) {
+	var copied Config
+	encoded, err := json.Marshal(config)
+	if err != nil {
+		return copied, err
+	}
+	err = json.Unmarshal(encoded, &copied)
+	return copied, err
+}
+
+// getConfigField returns the field of the configuration with the given JSON name
+func getConfigField(config *Config, name string) (reflect.Value, bool) {
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		tag := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		if tag == name && tag != "-" {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+func describeConfigType(fieldType reflect.Type) string {
+	switch fieldType.Kind() {
+	case reflect.Int:
+		return "number"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Slice:
+		return "list"
+	}
+	return fieldType.Kind().String()
+}
+
+// validateConfigField checks a patched field, returning why it is invalid or an empty string
+func validateConfigField(config *Config, name string) string {
+	switch name {
+	case "checkDisksInterval":
+		return checkPositive(config.CheckDisksInterval)
+	case "checkSubApplicationsInterval":
+		return checkPositive(config.CheckSubApplicationsInterval)
+	case "checkSubApplicationsUpdateInterval":
+		return checkPositive(config.CheckSubApplicationsUpdateInterval)
+	case "kitCatalogTTL":
+		return checkPositive(config.KitCatalogTTL)
+	case "applicationFolder":
+		return checkWritableFolder(config.ApplicationFolder)
+	case "logFolder":
+		return checkWritableFolder(config.LogFolder)
+	case "dataFolder":
+		return checkWritableFolder(config.DataFolder)
+	case "pythonInterpreter":
+		if config.PythonInterpreter != "" {
+			if _, err := exec.LookPath(config.PythonInterpreter); err != nil {
+				return fmt.Sprintf("interpreter %s not found", config.PythonInterpreter)
+			}
+		}
+	case "kitTrustPolicy":
+		return checkOneOf(config.KitTrustPolicy, "", "off", "flag", "reject")
+	case "kitRequirementPolicy":
+		return checkOneOf(config.KitRequirementPolicy, "", "refuse", "warn")
+	case "appKitRepositories":
+		return validateKitRepositories(config.AppKitRepositories)
+	case "listenAddress":
+		return checkListenAddress(config.ListenAddress)
+	case "listenAddresses":
+		for _, address := range config.ListenAddresses {
+			if message := checkListenAddress(address); message != "" {
+				return message
+			}
+		}
+	case "tlsCertFile":
+		return checkFileExists(config.TLSCertFile)
+	case "tlsKeyFile":
+		return checkFileExists(config.TLSKeyFile)
+	case "secretsKeyFile":
+		return checkFileExists(config.SecretsKeyFile)
+	}
+	return ""
+}
+
+func checkListenAddress(address string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return fmt.Sprintf("listen address %s must be host:port or :port", address)
+	}
+	return ""
+}
+
+func checkFileExists(path string) string {
+	if path == "" {
+		return ""
+	}
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Sprintf("file %s can't be read: %v", path, err)
+	}
+	return ""
+}
+
+func checkPositive(value int) string {
+	if value <= 0 {
+		return "must be greater than zero"
+	}
+	return ""
+}
+
+func checkOneOf(value string, allowed ...string) string {
+	for _, item := range allowed {
+		if strings.EqualFold(value, item) {
+			return ""
+		}
+	}
+	return fmt.Sprintf("must be one of %s", strings.Join(allowed[1:], ", "))
+}
+
+// checkWritableFolder checks that the folder, relative to the daemon if not absolute, can be written to.
+// Nothing is created, a missing folder is checked through the closest parent that exists.
+func checkWritableFolder(folder string) string {
+	if folder == "" {
+		return ""
+	}
+	if !filepath.IsAbs(folder) {
+		exPath, err := getCurrentPath()
+		if err != nil {
+			return err.Error()
+		}
+		folder = filepath.Join(exPath, folder)
+	}
+	existing := folder
+	for {
+		info, err := os.Stat(existing)
+		if err == nil {
+			if !info.IsDir() {
+				return fmt.Sprintf("folder %s can't be created, %s is not a folder", folder, existing)
+			}
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Sprintf("folder %s can't be read: %v", folder, err)
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			return fmt.Sprintf("folder %s can't be created, its drive doesn't exist", folder)
+		}
+		existing = parent
+	}
+	file, err := ioutil.TempFile(existing, ".write-check")
+	if err != nil {
+		return fmt.Sprintf("folder %s is not writable: %v", folder, err)
+	}
+	file.Close()
+	os.Remove(file.Name())
+	return ""
+}
+
+// validateKitRepositories checks that every kit repository can be read from
+func validateKitRepositories(repos []KitRepository) string {
+	problems := []string{}
+	for i, repo := range repos {
+		if _, err := newKitSource(repo); err != nil {
+			problems = append(problems, fmt.Sprintf("repository %d: %v", i+1, err))
+		}
+		for _, key := range repo.TrustedKeys {
+			publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+			if err != nil || len(publicKey) != ed25519.PublicKeySize {
+				problems = append(problems, fmt.Sprintf("repository %d: trusted key %s is not a base64 ed25519 public key", i+1, key))
+			}
+		}
+	}
+	return strings.Join(problems, "; ")
+}
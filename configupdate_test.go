@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testDir string
+
+func TestMain(m *testing.M) {
+	// logging broadcasts, nothing would receive the messages otherwise
+	go broadcastMessages()
+	dir, err := ioutil.TempDir("", "mrg-daemon-test")
+	if err != nil {
+		panic(err)
+	}
+	testDir = dir
+	configFilePath = filepath.Join(dir, configFile)
+	CurrentConfig = getDefaultConfig()
+	CurrentConfig.LogFolder = filepath.Join(dir, "logs")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+func TestPatchConfig(t *testing.T) {
+	// the cases run in order, each one starts from the configuration the previous one left
+	tests := []struct {
+		name   string
+		patch  string
+		errors []string // Fields the update is rejected for, nothing is applied then
+		check  func(config Config) bool
+	}{
+		{
+			name:  "sets a field",
+			patch: `{"kitCatalogTTL": 30, "kitTrustPolicy": "reject"}`,
+			check: func(config Config) bool { return config.KitCatalogTTL == 30 && config.KitTrustPolicy == "reject" },
+		},
+		{
+			name:  "leaves the fields missing from the patch alone",
+			patch: `{"kitCatalogTTL": 45}`,
+			check: func(config Config) bool { return config.KitCatalogTTL == 45 && config.KitTrustPolicy == "reject" },
+		},
+		{
+			name:  "null resets a field to its default",
+			patch: `{"kitCatalogTTL": null}`,
+			check: func(config Config) bool {
+				return config.KitCatalogTTL == getDefaultConfig().KitCatalogTTL && config.KitTrustPolicy == "reject"
+			},
+		},
+		{
+			name:  "sets a list",
+			patch: `{"listenAddresses": ["127.0.0.1:9000", "127.0.0.1:9001"]}`,
+			check: func(config Config) bool { return len(config.ListenAddresses) == 2 },
+		},
+		{
+			name:  "replaces a list instead of merging into it",
+			patch: `{"listenAddresses": ["127.0.0.1:9002"]}`,
+			check: func(config Config) bool {
+				return reflect.DeepEqual(config.ListenAddresses, []string{"127.0.0.1:9002"})
+			},
+		},
+		{
+			name:   "rejects a value of the wrong type",
+			patch:  `{"kitCatalogTTL": "soon"}`,
+			errors: []string{"kitCatalogTTL"},
+		},
+		{
+			name:   "rejects an unknown field",
+			patch:  `{"unknownField": 1}`,
+			errors: []string{"unknownField"},
+		},
+		{
+			name:   "rejects every invalid field and applies none",
+			patch:  `{"kitCatalogTTL": 0, "kitTrustPolicy": "maybe", "checkDisksInterval": 5}`,
+			errors: []string{"kitCatalogTTL", "kitTrustPolicy"},
+		},
+		{
+			name:   "rejects what isn't an object",
+			patch:  `[1, 2]`,
+			errors: []string{""},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			before, err := copyConfig(CurrentConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			config, err := patchConfig(json.RawMessage(test.patch), "test")
+			if len(test.errors) > 0 {
+				updateErr, ok := err.(*ConfigUpdateError)
+				if !ok {
+					t.Fatalf("expected a ConfigUpdateError, got %v", err)
+				}
+				fields := []string{}
+				for _, fieldErr := range updateErr.Errors {
+					fields = append(fields, fieldErr.Field)
+				}
+				if !reflect.DeepEqual(fields, test.errors) {
+					t.Errorf("rejected fields %v, expected %v", fields, test.errors)
+				}
+				if !reflect.DeepEqual(CurrentConfig, before) {
+					t.Errorf("a rejected update changed the configuration")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !test.check(*config) {
+				t.Errorf("unexpected configuration %+v", *config)
+			}
+		})
+	}
+}
+
+func TestPatchConfigOverridden(t *testing.T) {
+	configSources["checkDisksInterval"] = configLayerEnv
+	defer delete(configSources, "checkDisksInterval")
+	before := CurrentConfig.CheckDisksInterval
+	_, err := patchConfig(json.RawMessage(`{"checkDisksInterval": 5}`), "test")
+	updateErr, ok := err.(*ConfigUpdateError)
+	if !ok || len(updateErr.Errors) != 1 || updateErr.Errors[0].Field != "checkDisksInterval" {
+		t.Fatalf("expected the overridden field to be rejected, got %v", err)
+	}
+	if CurrentConfig.CheckDisksInterval != before {
+		t.Errorf("a rejected update changed the configuration")
+	}
+}
+
+func TestValidateConfigField(t *testing.T) {
+	file := filepath.Join(testDir, "not-a-folder")
+	err := ioutil.WriteFile(file, []byte("x"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(testDir, "missing", "nested")
+	tests := []struct {
+		name   string
+		field  string
+		config Config
+		valid  bool
+	}{
+		{"positive interval", "checkDisksInterval", Config{CheckDisksInterval: 1}, true},
+		{"zero interval", "checkDisksInterval", Config{CheckDisksInterval: 0}, false},
+		{"negative ttl", "kitCatalogTTL", Config{KitCatalogTTL: -1}, false},
+		{"known trust policy", "kitTrustPolicy", Config{KitTrustPolicy: "Reject"}, true},
+		{"empty trust policy", "kitTrustPolicy", Config{}, true},
+		{"unknown trust policy", "kitTrustPolicy", Config{KitTrustPolicy: "maybe"}, false},
+		{"unknown requirement policy", "kitRequirementPolicy", Config{KitRequirementPolicy: "ignore"}, false},
+		{"port only", "listenAddress", Config{ListenAddress: ":8180"}, true},
+		{"missing port", "listenAddress", Config{ListenAddress: "localhost"}, false},
+		{"one invalid address", "listenAddresses", Config{ListenAddresses: []string{":8180", "nowhere"}}, false},
+		{"existing folder", "dataFolder", Config{DataFolder: testDir}, true},
+		{"missing folder", "dataFolder", Config{DataFolder: missing}, true},
+		{"file instead of folder", "logFolder", Config{LogFolder: filepath.Join(file, "logs")}, false},
+		{"missing certificate", "tlsCertFile", Config{TLSCertFile: filepath.Join(testDir, "missing.pem")}, false},
+		{"field without checks", "disableMirrorCache", Config{DisableMirrorCache: true}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message := validateConfigField(&test.config, test.field)
+			if (message == "") != test.valid {
+				t.Errorf("validateConfigField(%s) = %q, expected valid %v", test.field, message, test.valid)
+			}
+		})
+	}
+	if _, err := os.Stat(missing); !os.IsNotExist(err) {
+		t.Errorf("validation created %s", missing)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/src-d/go-git.v4/plumbing/transport"
+	githttp "gopkg.in/src-d/go-git.v4/plumbing/transport/http"
+	gitssh "gopkg.in/src-d/go-git.v4/plumbing/transport/ssh"
+)
+
+// Credential gives access to the repositories whose location starts with Match
+type Credential struct {
+	Match            string `json:"match"`            // Host or repository prefix, e.g. github.com or github.com/org
+	Username         string `json:"username"`         // Username for HTTPS, defaults to git
+	Token            string `json:"token"`            // Token or password for HTTPS, can be a ${secret:NAME} reference
+	SSHKey           string `json:"sshKey"`           // Path to the private key for SSH remotes
+	SSHKeyPassphrase string `json:"sshKeyPassphrase"` // Passphrase of the private key, can be a ${secret:NAME} reference
+}
+
+// CredentialInfo is what the API shows of a credential, secrets are left out
+type CredentialInfo struct {
+	Match     string `json:"match"`
+	Username  string `json:"username"`
+	HasToken  bool   `json:"hasToken"`
+	HasSSHKey bool   `json:"hasSSHKey"`
+}
+
+var credentials []*Credential
+var credentialsMu sync.Mutex
+
+// readCredentials loads the credential store, a missing file means no credentials
+func readCredentials() error {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	content, err := getStateStore().Read(stateCredentials)
+	if os.IsNotExist(err) {
+		credentials = nil
+		return nil
+	}
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error opening credentials file: %v", err))
+		return err
+	}
+	var stored []*Credential
+	err = json.Unmarshal(content, &stored)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error decoding credentials file: %v", err))
+		return err
+	}
+	credentials = stored
+	return nil
+}
+
+// writeCredentials saves the credential store, readable only by the service account
+func writeCredentials() error {
+	content, err := json.MarshalIndent(credentials, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = getStateStore().Write(stateCredentials, append(content, '\n'))
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error creating credentials file: %v", err))
+	}
+	return err
+}
+
+// listCredentials returns the credentials without their secrets
+func listCredentials() []CredentialInfo {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	infos := []CredentialInfo{}
+	for _, credential := range credentials {
+		infos = append(infos, CredentialInfo{
+			Match:     credential.Match,
+			Username:  credential.Username,
+			HasToken:  credential.Token != "",
+			HasSSHKey: credential.SSHKey != "",
+		})
+	}
+	return infos
+}
+
+// setCredential adds or replaces the credential with the same match
+func setCredential(credential Credential) ([]CredentialInfo, error) {
+	credential.Match = normalizeRemote(credential.Match)
+	if credential.Match == "" {
+		return nil, fmt.Errorf("match is required")
+	}
+	if credential.Token == "" && credential.SSHKey == "" {
+		return nil, fmt.Errorf("a token or an ssh key is required")
+	}
+	credentialsMu.Lock()
+	replaced := false
+	for i, existing := range credentials {
+		if existing.Match == credential.Match {
+			credentials[i] = &credential
+			replaced = true
+		}
+	}
+	if !replaced {
+		credentials = append(credentials, &credential)
+	}
+	err := writeCredentials()
+	credentialsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return listCredentials(), nil
+}
+
+// deleteCredential removes the credential with the given match
+func deleteCredential(match string) ([]CredentialInfo, error) {
+	match = normalizeRemote(match)
+	credentialsMu.Lock()
+	for i, existing := range credentials {
+		if existing.Match == match {
+			credentials = append(credentials[:i], credentials[i+1:]...)
+			break
+		}
+	}
+	err := writeCredentials()
+	credentialsMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	return listCredentials(), nil
+}
+
+// normalizeRemote turns a repository location into host/path, without scheme, user or .git suffix.
+// owner/repo is understood as a GitHub repository.
+func normalizeRemote(remote string) string {
+	remote = strings.TrimSpace(remote)
+	if remote == "" {
+		return ""
+	}
+	if !strings.Contains(remote, "://") && !strings.Contains(remote, "@") && strings.Count(remote, "/") == 1 && !strings.Contains(strings.Split(remote, "/")[0], ".") {
+		remote = "github.com/" + remote
+	}
+	if !strings.Contains(remote, "://") && !strings.Contains(remote, "@") {
+		remote = "https://" + remote
+	}
+	endpoint, err := transport.NewEndpoint(remote)
+	if err != nil {
+		return ""
+	}
+	path := strings.TrimSuffix(strings.Trim(endpoint.Path, "/"), ".git")
+	return strings.TrimSuffix(strings.ToLower(endpoint.Host)+"/"+path, "/")
+}
+
+// findCredential returns the credential with the longest match for the repository
+func findCredential(remote string) *Credential {
+	location := normalizeRemote(remote)
+	if location == "" {
+		return nil
+	}
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+	var found *Credential
+	for _, credential := range credentials {
+		if location != credential.Match && !strings.HasPrefix(location, credential.Match+"/") {
+			continue
+		}
+		if found == nil || len(credential.Match) > len(found.Match) {
+			found = credential
+		}
+	}
+	return found
+}
+
+// isSSHRemote checks if the repository is accessed over SSH
+func isSSHRemote(remote string) bool {
+	endpoint, err := transport.NewEndpoint(remote)
+	return err == nil && endpoint.Protocol == "ssh"
+}
+
+// sshUser returns the user to log in as, the one of the credential, then the one of the remote, git by default
+func sshUser(remote string, credential *Credential) string {
+	if credential.Username != "" {
+		return credential.Username
+	}
+	if endpoint, err := transport.NewEndpoint(remote); err == nil && endpoint.User != "" {
+		return endpoint.User
+	}
+	return "git"
+}
+
+// isPlainHTTP checks if the repository is reached over unencrypted http
+func isPlainHTTP(remote string) bool {
+	endpoint, err := transport.NewEndpoint(remote)
+	return err == nil && endpoint.Protocol == "http"
+}
+
+// authForRemote returns the go-git authentication for the repository, nil for anonymous access
+func authForRemote(remote string) transport.AuthMethod {
+	credential := findCredential(remote)
+	if credential == nil {
+		return nil
+	}
+	if isSSHRemote(remote) {
+		if credential.SSHKey == "" {
+			return nil
+		}
+		auth, err := gitssh.NewPublicKeysFromFile(sshUser(remote, credential), credential.SSHKey, expandSecrets(credential.SSHKeyPassphrase))
+		if err != nil {
+			logToMainFile(fmt.Sprintf("Failed to load ssh key for %s: %v", credential.Match, err))
+			return nil
+		}
+		return auth
+	}
+	if credential.Token == "" {
+		return nil
+	}
+	if isPlainHTTP(remote) {
+		logToMainFile(fmt.Sprintf("Not sending the token of %s over plain http to %s", credential.Match, remote))
+		return nil
+	}
+	username := credential.Username
+	if username == "" {
+		username = "git"
+	}
+	return &githttp.BasicAuth{Username: username, Password: expandSecrets(credential.Token)}
+}
+
+// addAuthHeader authenticates an HTTP request made on behalf of the repository
+func addAuthHeader(req *http.Request, remote string) {
+	credential := findCredential(remote)
+	if credential == nil || credential.Token == "" {
+		return
+	}
+	if req.URL.Scheme != "https" {
+		logToMainFile(fmt.Sprintf("Not sending the token of %s over plain %s to %s", credential.Match, req.URL.Scheme, req.URL.Host))
+		return
+	}
+	req.Header.Set("Authorization", "token "+expandSecrets(credential.Token))
+}
+
+// moveURLCredentials moves a password or token embedded in the repository URL into the credential store
+func (subApp *SubApplication) moveURLCredentials() bool {
+	if !strings.Contains(subApp.RepoURL, "@") || isSSHRemote(subApp.RepoURL) {
+		return false
+	}
+	parsed, err := url.Parse(subApp.RepoURL)
+	if err != nil || parsed.User == nil {
+		return false
+	}
+	password, hasPassword := parsed.User.Password()
+	username := parsed.User.Username()
+	if !hasPassword {
+		// a lone token in the user part, as in https://token@github.com/org/repo
+		password, username = username, ""
+	}
+	parsed.User = nil
+	subApp.RepoURL = parsed.String()
+	_, err = setCredential(Credential{Match: subApp.RepoURL, Username: username, Token: password})
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Failed to store credentials for %s: %v", subApp.RepoURL, err))
+		return true
+	}
+	logToMainFile(fmt.Sprintf("Moved credentials of %s to the credential store", subApp.RepoURL))
+	return true
+}
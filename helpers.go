@@ -256,7 +256,8 @@ func getDataLocation() (string, error) {
 
 }
 
-func getInstallLocation(subApp *SubApplication) (string, error) {
+// getBaseInstallLocation returns the install location of the application, ignoring blue/green slots
+func getBaseInstallLocation(subApp *SubApplication) (string, error) {
 	//if no path is provided, use the id
 	if subApp.Path == "" {
 		subApp.Path = subApp.Id
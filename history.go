@@ -0,0 +1,308 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// files whose versions are kept
+const (
+	historyConfig          = "config"
+	historySubApplications = "subapplications"
+)
+
+// number of versions kept per file
+var historyLimit = 100
+
+var historyMu sync.Mutex
+
+// ConfigVersion is a saved version of config.json or subapplications.json
+type ConfigVersion struct {
+	Version int    `json:"version"` // Increasing number of the version
+	File    string `json:"file"`    // config or subapplications
+	Time    string `json:"time"`    // When the version was saved
+	Actor   string `json:"actor"`   // Who made the change: api with the client address, websocket, file or daemon
+	Reason  string `json:"reason"`  // Why the change was made
+	Hash    string `json:"hash"`    // Hash of the content the version is compared by
+}
+
+// HistoryRequest selects versions of a file, version 0 is the current state
+type HistoryRequest struct {
+	File    string `json:"file"`    // config or subapplications
+	From    int    `json:"from"`    // Version compared from
+	To      int    `json:"to"`      // Version compared to
+	Version int    `json:"version"` // Version rolled back to
+}
+
+// ConfigChange is a value that differs between two versions
+type ConfigChange struct {
+	Path string      `json:"path"` // Field, e.g. flags of application comfy is comfy/flags
+	From interface{} `json:"from"`
+	To   interface{} `json:"to"`
+}
+
+// getHistoryName returns the state name entry of the history of file is kept under, entry is
+// a version number or index. Only known files have a history.
+func getHistoryName(file string, entry string) (string, error) {
+	if file != historyConfig && file != historySubApplications {
+		return "", fmt.Errorf("unknown file %s", file)
+	}
+	return "history/" + file + "/" + entry, nil
+}
+
+// readHistory returns the versions of file, oldest first
+func readHistory(file string) ([]ConfigVersion, error) {
+	name, err := getHistoryName(file, "index")
+	if err != nil {
+		return nil, err
+	}
+	versions := []ConfigVersion{}
+	content, err := getStateStore().Read(name)
+	if os.IsNotExist(err) {
+		return versions, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, &versions)
+	return versions, err
+}
+
+// readVersion returns the content of a version
+func readVersion(file string, version int) ([]byte, error) {
+	name, err := getHistoryName(file, strconv.Itoa(version))
+	if err != nil {
+		return nil, err
+	}
+	content, err := getStateStore().Read(name)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("version %d of %s not found", version, file)
+	}
+	return content, err
+}
+
+// recordVersion keeps content as a new version of file unless it matches the last version.
+// previous is the content before the change, kept first when there is no history yet.
+func recordVersion(file string, content []byte, previous []byte, actor string, reason string) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	versions, err := readHistory(file)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Failed to read the history of %s: %v", file, err))
+		return
+	}
+	if len(versions) == 0 && len(previous) > 0 && hashVersion(file, previous) != hashVersion(file, content) {
+		versions, err = appendVersion(file, versions, previous, "daemon", "state before history was kept")
+		if err != nil {
+			logToMainFile(fmt.Sprintf("Failed to save the history of %s: %v", file, err))
+			return
+		}
+	}
+	if len(versions) > 0 && versions[len(versions)-1].Hash == hashVersion(file, content) {
+		return
+	}
+	if reason == "" && len(versions) > 0 {
+		if last, err := readVersion(file, versions[len(versions)-1].Version); err == nil {
+			reason = summarizeChanges(file, diffVersions(file, last, content))
+		}
+	}
+	_, err = appendVersion(file, versions, content, actor, reason)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Failed to save the history of %s: %v", file, err))
+	}
+}
+
+// appendVersion writes content as the next version and drops the oldest ones over the limit
+func appendVersion(file string, versions []ConfigVersion, content []byte, actor string, reason string) ([]ConfigVersion, error) {
+	index, err := getHistoryName(file, "index")
+	if err != nil {
+		return nil, err
+	}
+	next := 1
+	if len(versions) > 0 {
+		next = versions[len(versions)-1].Version + 1
+	}
+	name, _ := getHistoryName(file, strconv.Itoa(next))
+	err = getStateStore().Write(name, content)
+	if err != nil {
+		return nil, err
+	}
+	versions = append(versions, ConfigVersion{
+		Version: next,
+		File:    file,
+		Time:    time.Now().Format(time.RFC3339),
+		Actor:   actor,
+		Reason:  reason,
+		Hash:    hashVersion(file, content),
+	})
+	for len(versions) > historyLimit {
+		name, _ := getHistoryName(file, strconv.Itoa(versions[0].Version))
+		getStateStore().Remove(name)
+		versions = versions[1:]
+	}
+	content, err = json.MarshalIndent(versions, "", "    ")
+	if err != nil {
+		return nil, err
+	}
+	return versions, getStateStore().Write(index, content)
+}
+
+// hashVersion hashes what matters in a version: the whole configuration, but only the
+// definitions of the applications, so status changes don't create versions
+func hashVersion(file string, content []byte) string {
+	if encoded, err := json.Marshal(getVersionValue(file, content)); err == nil {
+		content = encoded
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// getVersionValue decodes a version for comparison, applications are keyed by id and
+// reduced to their definition
+func getVersionValue(file string, content []byte) interface{} {
+	if file != historySubApplications {
+		var value interface{}
+		json.Unmarshal(content, &value)
+		return value
+	}
+	var apps []*SubApplication
+	json.Unmarshal(content, &apps)
+	value := make(map[string]interface{})
+	for _, app := range apps {
+		value[app.Id] = getDefinition(app, subApplicationDefinitionFields)
+	}
+	return value
+}
+
+// diffVersions lists the values that differ between two contents of file
+func diffVersions(file string, from []byte, to []byte) []ConfigChange {
+	changes := []ConfigChange{}
+	diffValues("", getVersionValue(file, from), getVersionValue(file, to), &changes)
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Path < changes[j].Path })
+	return changes
+}
+
+// diffValues compares objects field by field and anything else as a whole
+func diffValues(path string, from interface{}, to interface{}, changes *[]ConfigChange) {
+	fromMap, fromIsMap := from.(map[string]interface{})
+	toMap, toIsMap := to.(map[string]interface{})
+	if fromIsMap && toIsMap {
+		for key, value := range fromMap {
+			diffValues(joinPath(path, key), value, toMap[key], changes)
+		}
+		for key, value := range toMap {
+			if _, ok := fromMap[key]; !ok {
+				diffValues(joinPath(path, key), nil, value, changes)
+			}
+		}
+		return
+	}
+	if !reflect.DeepEqual(from, to) {
+		*changes = append(*changes, ConfigChange{Path: path, From: from, To: to})
+	}
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "/" + key
+}
+
+// summarizeChanges describes the changes in a few words, used when no reason is given
+func summarizeChanges(file string, changes []ConfigChange) string {
+	names := []string{}
+	seen := make(map[string]bool)
+	for _, change := range changes {
+		name := change.Path
+		if file == historySubApplications {
+			name = strings.SplitN(change.Path, "/", 2)[0]
+		}
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	if file == historySubApplications {
+		return "changed applications " + strings.Join(names, ", ")
+	}
+	return "changed " + strings.Join(names, ", ")
+}
+
+// getVersionContent returns the content of a version, version 0 is the current state
+func getVersionContent(file string, version int) ([]byte, error) {
+	if version > 0 {
+		return readVersion(file, version)
+	}
+	switch file {
+	case historyConfig:
+		return json.Marshal(getFileConfig())
+	case historySubApplications:
+		return json.Marshal(subApplications)
+	}
+	return nil, fmt.Errorf("unknown file %s", file)
+}
+
+// diffHistory compares two versions of file, 0 is the current state
+func diffHistory(file string, from int, to int) ([]ConfigChange, error) {
+	fromContent, err := getVersionContent(file, from)
+	if err != nil {
+		return nil, err
+	}
+	toContent, err := getVersionContent(file, to)
+	if err != nil {
+		return nil, err
+	}
+	return diffVersions(file, fromContent, toContent), nil
+}
+
+// rollbackHistory applies a version of file through the same path as an update: the configuration
+// is validated and patched, applications are stopped, restarted and started as needed
+func rollbackHistory(file string, version int, actor string) (interface{}, error) {
+	content, err := readVersion(file, version)
+	if err != nil {
+		return nil, err
+	}
+	reason := fmt.Sprintf("rollback to version %d", version)
+	logToMainFile(fmt.Sprintf("Rolling back %s to version %d", file, version))
+	switch file {
+	case historyConfig:
+		var fields map[string]json.RawMessage
+		err := json.Unmarshal(content, &fields)
+		if err != nil {
+			return nil, err
+		}
+		// fields missing from the version go back to their default, fields set by the
+		// environment or the command line keep their value
+		fieldType := reflect.TypeOf(Config{})
+		for i := 0; i < fieldType.NumField(); i++ {
+			name := getConfigFieldName(fieldType.Field(i))
+			if getOverrideMessage(name) != "" {
+				delete(fields, name)
+			} else if _, ok := fields[name]; !ok {
+				fields[name] = json.RawMessage("null")
+			}
+		}
+		patch, err := json.Marshal(fields)
+		if err != nil {
+			return nil, err
+		}
+		return patchConfigAs(patch, actor, reason)
+	case historySubApplications:
+		_, err := applySubApplications(content, actor, reason)
+		if err != nil {
+			return nil, err
+		}
+		return subApplications, nil
+	}
+	return nil, fmt.Errorf("unknown file %s", file)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// absolute path inside a string value, e.g. D:\models, \\server\share or /mnt/models, at the start
+// of the value or after a space, = or quote so URLs and ${dir}/... aren't taken for paths
+var absolutePathPattern = regexp.MustCompile(`(^|[\s="',])((?:[A-Za-z]:[\\/]|\\\\[^\\/\s"'<>|*?]|/[^/\s"'<>|*?])[^\s"'<>|*?]*)`)
+
+// KitExportRequest exports an application as a kit entry, optionally into a local kit repository
+type KitExportRequest struct {
+	Folder  string `json:"folder"`  // Local kit repository the entry is written to, nothing is written if empty
+	Id      string `json:"id"`      // Id of the kit, defaults to the id of the application
+	Version string `json:"version"` // Version of the kit, defaults to the next version of the kit it came from
+}
+
+// KitExport is the exported kit entry and where it was written
+type KitExport struct {
+	Kit  map[string]interface{} `json:"kit"`  // The kit entry, as it appears in list.json
+	File string                 `json:"file"` // list.json the entry was written to
+}
+
+// exportKit turns the application into a kit entry. Runtime state is dropped, paths inside the
+// install location become relative, other absolute paths become path parameters and the
+// current commit is pinned.
+func (subAppDef *SubApplication) exportKit(request KitExportRequest) (*KitExport, error) {
+	subApp := subAppDef.getCurrent()
+	if subApp == nil {
+		return nil, fmt.Errorf("invalid app")
+	}
+	installLoc, err := getInstallLocation(subApp)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := getKitDefinition(subApp)
+	entry["id"] = subApp.Id
+	if request.Id != "" {
+		entry["id"] = request.Id
+	}
+	entry["schemaVersion"] = kitSchemaVersion
+	entry["version"] = request.Version
+	if request.Version == "" {
+		entry["version"] = nextKitVersion(subApp.KitVersion)
+	}
+	if subApp.Path != "" && subApp.Path != subApp.Id && isSafeRelativePath(subApp.Path) {
+		entry["path"] = subApp.Path
+	}
+	if subApp.Installed {
+		repo, err := git.PlainOpen(installLoc)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open repository: %v", err)
+		}
+		if commit := headCommit(repo); commit != "" {
+			entry["commit"] = commit
+		}
+	}
+
+	params := &exportedParameters{installLoc: installLoc, names: make(map[string]string)}
+	// named in a stable order, so exporting twice gives the same parameters
+	fields := []string{}
+	for field := range entry {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		params.expanded = field == "command" || field == "commandExec" || field == "flags" || field == "setupSteps"
+		entry[field] = params.replacePaths(entry[field], "")
+	}
+	if len(params.declared) > 0 {
+		entry["parameters"] = params.declared
+	}
+
+	// the entry must be readable by the daemon that imports it
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	kits, err := parseKitList(append(append([]byte("["), encoded...), ']'), "export")
+	if err != nil {
+		return nil, err
+	}
+	if !kits[0].isValid() {
+		return nil, fmt.Errorf("exported kit is invalid: %s", strings.Join(kits[0].Errors, "; "))
+	}
+
+	export := &KitExport{Kit: entry}
+	if request.Folder != "" {
+		if !isLocalKitRepository(request.Folder) {
+			return nil, fmt.Errorf("folder %s is not a configured local kit repository", request.Folder)
+		}
+		export.File, err = writeKitEntry(request.Folder, entry)
+		if err != nil {
+			logToFile("log", fmt.Sprintf("Failed to export kit to %s: %v", request.Folder, err), subApp, true)
+			return nil, err
+		}
+		logToFile("log", fmt.Sprintf("Exported kit %s to %s", entry["id"], export.File), subApp, true)
+	}
+	return export, nil
+}
+
+// exportedParameters collects the parameters created for absolute paths during an export
+type exportedParameters struct {
+	installLoc string
+	names      map[string]string // parameter name by path
+	expanded   bool              // The field goes through expandPlaceholders, so ${dir} can be used
+	declared   []KitParameter
+}
+
+// replacePaths replaces the absolute paths in the string values of value, flag is the option
+// the value belongs to and names the parameter
+func (params *exportedParameters) replacePaths(value interface{}, flag string) interface{} {
+	switch typed := value.(type) {
+	case string:
+		if flag == "" && strings.HasPrefix(typed, "-") {
+			flag = strings.SplitN(strings.Fields(typed + " ")[0], "=", 2)[0]
+		}
+		return absolutePathPattern.ReplaceAllStringFunc(typed, func(match string) string {
+			parts := absolutePathPattern.FindStringSubmatch(match)
+			return parts[1] + params.placeholder(parts[2], flag)
+		})
+	case []interface{}:
+		for i := range typed {
+			typed[i] = params.replacePaths(typed[i], flag)
+		}
+	case map[string]interface{}:
+		for key := range typed {
+			typed[key] = params.replacePaths(typed[key], flag)
+		}
+	}
+	return value
+}
+
+// placeholder returns what replaces path in the kit, a path relative to the install location
+// or a parameter placeholder
+func (params *exportedParameters) placeholder(path string, flag string) string {
+	if relative, err := filepath.Rel(params.installLoc, path); err == nil && (relative == "." || isSafeRelativePath(relative)) {
+		if !params.expanded {
+			return filepath.ToSlash(relative)
+		}
+		if relative == "." {
+			return "${dir}"
+		}
+		return "${dir}/" + filepath.ToSlash(relative)
+	}
+	name, ok := params.names[path]
+	if !ok {
+		name = strings.ReplaceAll(strings.TrimLeft(flag, "-"), "-", "_")
+		if name == "" {
+			name = "path"
+		}
+		for i := 2; params.isDeclared(name); i++ {
+			name = fmt.Sprintf("%s%d", strings.TrimRight(name, "0123456789"), i)
+		}
+		params.names[path] = name
+		description := fmt.Sprintf("Folder, was %s where the kit was exported", path)
+		if flag != "" {
+			description = fmt.Sprintf("Folder passed to %s, was %s where the kit was exported", flag, path)
+		}
+		params.declared = append(params.declared, KitParameter{Name: name, Type: "path", Description: description, Required: true})
+	}
+	return "{{" + name + "}}"
+}
+
+func (params *exportedParameters) isDeclared(name string) bool {
+	for _, param := range params.declared {
+		if param.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nextKitVersion raises the last number of a version, 1 if there is none
+func nextKitVersion(version string) string {
+	if version == "" {
+		return "1"
+	}
+	parts := strings.Split(version, ".")
+	last := parts[len(parts)-1]
+	var number int
+	if _, err := fmt.Sscanf(last, "%d", &number); err != nil || fmt.Sprint(number) != last {
+		return version + ".1"
+	}
+	parts[len(parts)-1] = fmt.Sprint(number + 1)
+	return strings.Join(parts, ".")
+}
+
+// isLocalKitRepository checks if folder is one of the configured local kit repositories
+func isLocalKitRepository(folder string) bool {
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return false
+	}
+	for _, repo := range getKitRepositories() {
+		if repo.getType() != "local" {
+			continue
+		}
+		location, err := filepath.Abs(strings.TrimPrefix(repo.Location, "file://"))
+		if err == nil && strings.EqualFold(location, folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeKitEntry adds the entry to list.json in folder, replacing the kit with the same id.
+// The list keeps its format, a plain array stays an array.
+func writeKitEntry(folder string, entry map[string]interface{}) (string, error) {
+	err := os.MkdirAll(folder, os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+	file := filepath.Join(folder, kitListFile)
+	list := KitList{SchemaVersion: kitSchemaVersion}
+	plain := false
+	content, err := ioutil.ReadFile(file)
+	if err == nil {
+		content = bytes.TrimSpace(content)
+		plain = bytes.HasPrefix(content, []byte("["))
+		if plain {
+			err = json.Unmarshal(content, &list.Kits)
+		} else {
+			err = json.Unmarshal(content, &list)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %v", file, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+
+	encoded, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	replaced := false
+	for i, raw := range list.Kits {
+		var existing struct {
+			Id string `json:"id"`
+		}
+		if json.Unmarshal(raw, &existing) == nil && existing.Id == entry["id"] {
+			list.Kits[i] = encoded
+			replaced = true
+		}
+	}
+	if !replaced {
+		list.Kits = append(list.Kits, encoded)
+	}
+
+	var output []byte
+	if plain {
+		output, err = json.MarshalIndent(list.Kits, "", "  ")
+	} else {
+		output, err = json.MarshalIndent(list, "", "  ")
+	}
+	if err != nil {
+		return "", err
+	}
+	err = writeFileAtomic(file, output, 0644)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(filepath.Join(folder, kitSignatureFile)); err == nil {
+		logToMainFile(fmt.Sprintf("%s changed, its signature %s must be renewed", file, kitSignatureFile))
+	}
+	return file, nil
+}
+
+// checkoutPinnedCommit checks out the commit a kit pinned the application to
+func (subApp *SubApplication) checkoutPinnedCommit(repo *git.Repository) error {
+	if subApp.Commit == "" {
+		return nil
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Checkout(&git.CheckoutOptions{Hash: plumbing.NewHash(subApp.Commit)})
+}
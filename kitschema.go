@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// latest kit schema version understood by the daemon, lists without a version are version 1
+var kitSchemaVersion = 1
+
+// application types a kit may declare, empty is a generic application
+var allowedAppTypes = []string{"", "generic", "comfy", "mrg"}
+
+// Kit is an entry of a kit list, an application that can be added and installed
+type Kit struct {
+	SubApplication
+	SchemaVersion int            `json:"schemaVersion"` // Schema version of the entry
+	Version       string         `json:"version"`       // Version of the kit definition, raised when it changes
+	Source        string         `json:"source"`        // Kit repository the entry comes from
+	Trust         string         `json:"trust"`         // Whether the kit list is verified, unsigned or invalid
+	Parameters    []KitParameter `json:"parameters"`    // Values asked when the kit is added
+	Description   string         `json:"description"`   // What the kit installs
+	Category      string         `json:"category"`      // Category the kit is listed under
+	Tags          []string       `json:"tags"`          // Keywords the kit can be searched by
+	State         string         `json:"state"`         // installed, updateAvailable or notInstalled, joined from the applications
+	Instances     int            `json:"instances"`     // Number of installed applications created from the kit
+	Apps          []string       `json:"apps"`          // Ids of the applications created from the kit
+	Errors        []string       `json:"errors"`        // Validation errors, a kit with errors can't be installed
+}
+
+// KitList is the versioned format of list.json, a plain array of kits is read as version 1
+type KitList struct {
+	SchemaVersion int               `json:"schemaVersion"`
+	Kits          []json.RawMessage `json:"kits"`
+}
+
+// isValid checks if the kit passed validation
+func (kit Kit) isValid() bool {
+	return len(kit.Errors) == 0
+}
+
+// parseKitList decodes and validates each entry of a kit list on its own, so a bad entry
+// is reported instead of dropping the whole list
+func parseKitList(content []byte, source string) ([]Kit, error) {
+	list := KitList{SchemaVersion: 1}
+	content = bytes.TrimSpace(content)
+	if bytes.HasPrefix(content, []byte("[")) {
+		err := json.Unmarshal(content, &list.Kits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal kits list: %v", err)
+		}
+	} else {
+		err := json.Unmarshal(content, &list)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal kits list: %v", err)
+		}
+		if list.SchemaVersion > kitSchemaVersion {
+			return nil, fmt.Errorf("kits list uses schema version %d, this daemon supports up to %d", list.SchemaVersion, kitSchemaVersion)
+		}
+	}
+
+	kits := []Kit{}
+	for i, raw := range list.Kits {
+		kit := Kit{SchemaVersion: list.SchemaVersion}
+		err := json.Unmarshal(raw, &kit)
+		if err != nil && kitParameterPattern.Match(raw) {
+			// the template is typed, parameters can't stand for numbers or booleans
+			kit = Kit{Errors: []string{fmt.Sprintf("invalid entry, {{parameter}} placeholders are only allowed in string fields: %v", err)}}
+		} else if err != nil {
+			kit = Kit{Errors: []string{fmt.Sprintf("invalid entry: %v", err)}}
+		} else {
+			kit.RepoURL = expandRemote(kit.RepoURL)
+			kit.Errors = kit.validate()
+		}
+		kit.Source = source
+		if kit.Name == "" {
+			kit.Name = fmt.Sprintf("entry %d", i+1)
+		}
+		if !kit.isValid() {
+			logToMainFile(fmt.Sprintf("Kit %s from %s is invalid: %s", kit.Name, source, strings.Join(kit.Errors, "; ")))
+		}
+		kits = append(kits, kit)
+	}
+	return kits, nil
+}
+
+// validate checks the kit against the schema and returns the problems found
+func (kit *Kit) validate() []string {
+	errors := []string{}
+	if kit.SchemaVersion > kitSchemaVersion {
+		errors = append(errors, fmt.Sprintf("schema version %d is not supported, this daemon supports up to %d", kit.SchemaVersion, kitSchemaVersion))
+	}
+	if strings.TrimSpace(kit.Id) == "" {
+		errors = append(errors, "id is required")
+	}
+	if strings.TrimSpace(kit.Name) == "" {
+		errors = append(errors, "name is required")
+	}
+	if kit.RepoURL == "" {
+		errors = append(errors, "repoURL is required")
+	} else if !isValidRemote(kit.RepoURL) {
+		errors = append(errors, fmt.Sprintf("repoURL %s is not a valid repository location", kit.RepoURL))
+	}
+	if strings.ContainsAny(kit.Branch, " \t~^:?*[\\") {
+		errors = append(errors, fmt.Sprintf("branch %s is not a valid branch name", kit.Branch))
+	}
+	validType := false
+	for _, appType := range allowedAppTypes {
+		if kit.AppType == appType {
+			validType = true
+		}
+	}
+	if !validType {
+		errors = append(errors, fmt.Sprintf("appType %s is not one of %s", kit.AppType, strings.Join(allowedAppTypes[1:], ", ")))
+	}
+	if strings.TrimSpace(kit.CommandExec) == "" {
+		errors = append(errors, "commandExec is required")
+	}
+	if kit.Path != "" && !isSafeRelativePath(kit.Path) {
+		errors = append(errors, fmt.Sprintf("path %s must be relative and stay inside the applications folder", kit.Path))
+	}
+	for source, destination := range kit.SymLinks {
+		if !isSafeRelativePath(source) {
+			errors = append(errors, fmt.Sprintf("symlink %s must be relative and stay inside the install location", source))
+		}
+		if !isSafeRelativePath(destination) {
+			errors = append(errors, fmt.Sprintf("symlink target %s must be relative and stay inside the data folder", destination))
+		}
+	}
+	// the legacy setup command is checked as the step it is converted to
+	stepNames := make(map[string]bool)
+	for i, step := range kit.getSetupSteps() {
+		if step.Name != "" && stepNames[step.Name] {
+			errors = append(errors, fmt.Sprintf("setup step %d has the same name as an earlier step, %s", i+1, step.Name))
+		}
+		stepNames[step.Name] = true
+		if strings.TrimSpace(step.Command) == "" {
+			errors = append(errors, fmt.Sprintf("setup step %d has no command", i+1))
+		}
+		if step.Name == pythonStepName {
+			errors = append(errors, fmt.Sprintf("setup step %d can't be named %s, the name is reserved for the python environment", i+1, pythonStepName))
+		}
+		if step.WorkingDir != "" && !isSafeRelativePath(step.WorkingDir) {
+			errors = append(errors, fmt.Sprintf("setup step %d working directory must stay inside the install location", i+1))
+		}
+	}
+	if kit.Python != nil && kit.Python.Path != "" && !isSafeRelativePath(kit.Python.Path) {
+		errors = append(errors, fmt.Sprintf("python path %s must stay inside the install location", kit.Python.Path))
+	}
+	if kit.Requirements != nil {
+		errors = append(errors, kit.Requirements.validate()...)
+	}
+	return append(errors, kit.validateParameters()...)
+}
+
+// isValidRemote checks if the location is a repository the daemon can clone
+func isValidRemote(remote string) bool {
+	if normalizeRemote(remote) == "" || strings.ContainsAny(remote, " \t") {
+		return false
+	}
+	if isSSHRemote(remote) {
+		return true
+	}
+	if strings.Contains(remote, "://") {
+		return strings.HasPrefix(remote, "https://") || strings.HasPrefix(remote, "http://")
+	}
+	// owner/repo shorthand
+	return strings.Count(remote, "/") == 1
+}
+
+// expandRemote turns the owner/repo shorthand into the GitHub repository it stands for
+func expandRemote(remote string) string {
+	if isValidRemote(remote) && !isSSHRemote(remote) && !strings.Contains(remote, "://") {
+		return "https://github.com/" + remote
+	}
+	return remote
+}
+
+// isSafeRelativePath checks that the path is relative and doesn't climb out of its folder
+func isSafeRelativePath(path string) bool {
+	if strings.TrimSpace(path) == "" || filepath.IsAbs(path) || strings.HasPrefix(path, "/") || strings.HasPrefix(path, "\\") || filepath.VolumeName(path) != "" {
+		return false
+	}
+	for _, part := range strings.FieldsFunc(path, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if part == ".." || strings.Contains(part, ":") {
+			return false
+		}
+	}
+	return true
+}
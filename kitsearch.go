@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// install states of a kit, joined from the applications created from it
+const (
+	kitStateInstalled       = "installed"
+	kitStateUpdateAvailable = "updateAvailable"
+	kitStateNotInstalled    = "notInstalled"
+)
+
+// KitRequirements is what a kit needs from the host, sizes are in GB
+type KitRequirements struct {
+	DiskGB      int      `json:"diskGB"`      // Free space needed in the applications folder
+	DataDiskGB  int      `json:"dataDiskGB"`  // Free space needed in the data folder, e.g. for models
+	RAMGB       int      `json:"ramGB"`       // Memory needed
+	VRAMGB      int      `json:"vramGB"`      // GPU memory needed
+	GPU         string   `json:"gpu"`         // GPU vendor needed: nvidia, amd or intel, any if empty
+	Executables []string `json:"executables"` // Executables that must be on PATH, e.g. git or ffmpeg
+	OS          []string `json:"os"`          // Operating systems the kit runs on, any if empty
+	Arch        []string `json:"arch"`        // Architectures the kit runs on, any if empty
+}
+
+// GPU vendors a kit may require
+var kitGPUVendors = []string{"", "nvidia", "amd", "intel"}
+
+// validate checks the declared requirements
+func (requirements *KitRequirements) validate() []string {
+	errors := []string{}
+	if requirements.DiskGB < 0 || requirements.DataDiskGB < 0 || requirements.RAMGB < 0 || requirements.VRAMGB < 0 {
+		errors = append(errors, "requirements can't be negative")
+	}
+	validGPU := false
+	for _, vendor := range kitGPUVendors {
+		if strings.EqualFold(requirements.GPU, vendor) {
+			validGPU = true
+		}
+	}
+	if !validGPU {
+		errors = append(errors, fmt.Sprintf("gpu %s is not one of %s", requirements.GPU, strings.Join(kitGPUVendors[1:], ", ")))
+	}
+	return errors
+}
+
+// KitQuery filters the kits, empty fields match every kit
+type KitQuery struct {
+	Text     string   `json:"text"`     // Words that must all appear in the id, name, description, category or tags
+	Tags     []string `json:"tags"`     // Tags the kit must all have
+	Category string   `json:"category"` // Category of the kit
+	State    string   `json:"state"`    // installed, updateAvailable or notInstalled
+}
+
+// searchKits returns the kits matching the query, with their install state
+func searchKits(query KitQuery) []Kit {
+	kits := []Kit{}
+	catalog := getKitCatalog(false).Kits
+	recordLegacyKits(catalog)
+	for _, kit := range catalog {
+		kit.joinApplications()
+		if query.matches(&kit) {
+			kits = append(kits, kit)
+		}
+	}
+	broadcastToSocket("kits", kits)
+	return kits
+}
+
+// joinApplications sets the install state of the kit from the applications created from it
+func (kit *Kit) joinApplications() {
+	kit.State = kitStateNotInstalled
+	kit.Instances = 0
+	kit.Apps = []string{}
+	updates := false
+	for _, subApp := range subApplications {
+		if !subApp.isFromKit(kit.Id) {
+			continue
+		}
+		kit.Apps = append(kit.Apps, subApp.Id)
+		if subApp.Installed {
+			kit.Instances++
+			if subApp.HasUpdates || subApp.KitUpgrade != "" {
+				updates = true
+			}
+		}
+	}
+	if kit.Instances > 0 {
+		kit.State = kitStateInstalled
+		if updates {
+			kit.State = kitStateUpdateAvailable
+		}
+	}
+}
+
+// isFromKit checks if the application was created from the kit
+func (subApp *SubApplication) isFromKit(kitId string) bool {
+	return kitId != "" && subApp.KitId == kitId
+}
+
+// recordLegacyKits records the kit of applications added before kits were tracked, which share
+// the id of their kit, so they are joined on KitId like the others
+func recordLegacyKits(kits []Kit) {
+	changed := false
+	for _, subApp := range subApplications {
+		if subApp.KitId != "" {
+			continue
+		}
+		for _, kit := range kits {
+			if kit.Id != "" && kit.Id == subApp.Id {
+				subApp.KitId = kit.Id
+				changed = true
+				break
+			}
+		}
+	}
+	if changed {
+		saveSubApplications()
+	}
+}
+
+// matches checks if the kit matches every part of the query
+func (query *KitQuery) matches(kit *Kit) bool {
+	if query.State != "" && !strings.EqualFold(query.State, kit.State) {
+		return false
+	}
+	if query.Category != "" && !strings.EqualFold(query.Category, kit.Category) {
+		return false
+	}
+	for _, tag := range query.Tags {
+		if !kit.hasTag(tag) {
+			return false
+		}
+	}
+	text := strings.ToLower(strings.Join(append([]string{kit.Id, kit.Name, kit.Description, kit.Category}, kit.Tags...), " "))
+	for _, word := range strings.Fields(strings.ToLower(query.Text)) {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func (kit *Kit) hasTag(tag string) bool {
+	for _, kitTag := range kit.Tags {
+		if strings.EqualFold(strings.TrimSpace(tag), kitTag) {
+			return true
+		}
+	}
+	return false
+}
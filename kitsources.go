@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// file listing the kits of a kit repository
+var kitListFile = "list.json"
+
+// KitRepository is a configured location kits are listed from
+type KitRepository struct {
+	Type        string   `json:"type"`        // github, local, http, git, gitlab or gitea, guessed from the location if empty
+	Location    string   `json:"location"`    // owner/repo, folder, base URL or git remote, depending on the type
+	Ref         string   `json:"ref"`         // Branch, tag or commit to read from, the default branch if empty
+	TrustedKeys []string `json:"trustedKeys"` // Base64 ed25519 public keys allowed to sign the kit list
+}
+
+// KitSource reads the files of a kit repository
+type KitSource interface {
+	ReadFile(path string) ([]byte, error)
+	String() string
+}
+
+// conditionalKitSource is a kit source that can skip downloading files that didn't change
+type conditionalKitSource interface {
+	ReadFileConditional(path string, validators *kitValidators) ([]byte, error)
+}
+
+// kitValidators carries the validators of a conditional request, and the time until which
+// the server asked not to be called again
+type kitValidators struct {
+	ETag         string
+	LastModified string
+	RetryAfter   time.Time
+}
+
+// errNotModified is returned by conditional reads when the file didn't change
+var errNotModified = errors.New("not modified")
+
+// UnmarshalJSON accepts a plain location as well, as used by older configurations
+func (repo *KitRepository) UnmarshalJSON(data []byte) error {
+	var location string
+	if err := json.Unmarshal(data, &location); err == nil {
+		*repo = KitRepository{Location: location}
+		return nil
+	}
+	type plain KitRepository
+	return json.Unmarshal(data, (*plain)(repo))
+}
+
+// getType returns the type of the repository, guessing it from the location if not set
+func (repo KitRepository) getType() string {
+	if repo.Type != "" {
+		return strings.ToLower(repo.Type)
+	}
+	location := repo.Location
+	switch {
+	case strings.HasPrefix(location, "file://") || filepath.IsAbs(location) || strings.HasPrefix(location, "."):
+		return "local"
+	case isSSHRemote(location) || strings.HasSuffix(location, ".git"):
+		return "git"
+	case strings.HasPrefix(normalizeRemote(location), "github.com/"):
+		return "github"
+	case strings.HasPrefix(normalizeRemote(location), "gitlab.com/"):
+		return "gitlab"
+	case strings.HasPrefix(location, "http://") || strings.HasPrefix(location, "https://"):
+		return "http"
+	}
+	return "github"
+}
+
+// newKitSource returns the source matching the type of the repository
+func newKitSource(repo KitRepository) (KitSource, error) {
+	if repo.Location == "" {
+		return nil, fmt.Errorf("kit repository has no location")
+	}
+	switch repo.getType() {
+	case "github":
+		return &githubKitSource{repo: repo.Location, ref: repo.Ref}, nil
+	case "local":
+		return &localKitSource{dir: strings.TrimPrefix(repo.Location, "file://")}, nil
+	case "http":
+		return &httpKitSource{baseURL: repo.Location}, nil
+	case "git":
+		return &gitKitSource{remote: repo.Location, ref: repo.Ref}, nil
+	case "gitlab":
+		return newRawKitSource(repo, "gitlab")
+	case "gitea":
+		return newRawKitSource(repo, "gitea")
+	}
+	return nil, fmt.Errorf("unknown kit repository type %s", repo.Type)
+}
+
+// githubKitSource reads files through the GitHub contents API
+type githubKitSource struct {
+	repo string
+	ref  string
+}
+
+func (source *githubKitSource) ReadFile(path string) ([]byte, error) {
+	return source.ReadFileConditional(path, &kitValidators{})
+}
+
+func (source *githubKitSource) ReadFileConditional(path string, validators *kitValidators) ([]byte, error) {
+	if source.ref != "" {
+		path = path + "?ref=" + url.QueryEscape(source.ref)
+	}
+	content, err := readGitHubFile(source.repo, path, validators)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(content), nil
+}
+
+func (source *githubKitSource) String() string {
+	return source.repo
+}
+
+// localKitSource reads files from a folder
+type localKitSource struct {
+	dir string
+}
+
+func (source *localKitSource) ReadFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(source.dir, filepath.FromSlash(path)))
+}
+
+func (source *localKitSource) String() string {
+	return source.dir
+}
+
+// httpKitSource reads files relative to a base URL
+type httpKitSource struct {
+	baseURL string
+}
+
+func (source *httpKitSource) ReadFile(path string) ([]byte, error) {
+	return source.ReadFileConditional(path, &kitValidators{})
+}
+
+func (source *httpKitSource) ReadFileConditional(path string, validators *kitValidators) ([]byte, error) {
+	return readHTTPFile(strings.TrimSuffix(source.baseURL, "/")+"/"+path, source.baseURL, "", validators)
+}
+
+func (source *httpKitSource) String() string {
+	return source.baseURL
+}
+
+// rawKitSource reads files through the raw endpoint of a GitLab or Gitea server
+type rawKitSource struct {
+	kind    string
+	baseURL string
+	project string
+	ref     string
+}
+
+func newRawKitSource(repo KitRepository, kind string) (KitSource, error) {
+	location := repo.Location
+	if !strings.Contains(location, "://") {
+		location = "https://" + location
+	}
+	parsed, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s repository %s: %v", kind, repo.Location, err)
+	}
+	project := strings.TrimSuffix(strings.Trim(parsed.Path, "/"), ".git")
+	if project == "" {
+		return nil, fmt.Errorf("invalid %s repository %s", kind, repo.Location)
+	}
+	return &rawKitSource{kind: kind, baseURL: parsed.Scheme + "://" + parsed.Host, project: project, ref: repo.Ref}, nil
+}
+
+func (source *rawKitSource) ReadFile(path string) ([]byte, error) {
+	return source.ReadFileConditional(path, &kitValidators{})
+}
+
+func (source *rawKitSource) ReadFileConditional(path string, validators *kitValidators) ([]byte, error) {
+	var fileURL string
+	if source.kind == "gitlab" {
+		ref := source.ref
+		if ref == "" {
+			ref = "HEAD"
+		}
+		fileURL = fmt.Sprintf("%s/%s/-/raw/%s/%s", source.baseURL, source.project, ref, path)
+		return readHTTPFile(fileURL, source.String(), "PRIVATE-TOKEN", validators)
+	}
+	if source.ref == "" {
+		fileURL = fmt.Sprintf("%s/%s/raw/%s", source.baseURL, source.project, path)
+	} else {
+		fileURL = fmt.Sprintf("%s/%s/raw/branch/%s/%s", source.baseURL, source.project, source.ref, path)
+	}
+	return readHTTPFile(fileURL, source.String(), "", validators)
+}
+
+func (source *rawKitSource) String() string {
+	return source.baseURL + "/" + source.project
+}
+
+// gitKitSource reads files from any git remote, through its bare mirror unless the mirror cache is disabled
+type gitKitSource struct {
+	remote string
+	ref    string
+}
+
+// open returns the mirror of the remote, or a copy in memory without the mirror cache
+func (source *gitKitSource) open() (*git.Repository, error) {
+	if !useMirrors() {
+		return fetchInMemory(source.remote)
+	}
+	mirrorLoc, err := refreshMirror(source.remote)
+	if err != nil {
+		return nil, err
+	}
+	return git.PlainOpen(mirrorLoc)
+}
+
+func (source *gitKitSource) ReadFile(path string) ([]byte, error) {
+	mirror, err := source.open()
+	if err != nil {
+		return nil, err
+	}
+	revision := source.ref
+	if revision == "" {
+		revision = string(plumbing.HEAD)
+	}
+	hash, err := mirror.ResolveRevision(plumbing.Revision(revision))
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve %s in %s: %v", revision, source.remote, err)
+	}
+	commit, err := mirror.CommitObject(*hash)
+	if err != nil {
+		return nil, err
+	}
+	file, err := commit.File(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from %s: %v", path, source.remote, err)
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	return []byte(content), nil
+}
+
+func (source *gitKitSource) String() string {
+	return source.remote
+}
+
+// readHTTPFile downloads a file, authenticating with the credential of the repository.
+// authHeader replaces the default Authorization header for servers that use another one.
+// The request is conditional on the validators, which are updated from the response.
+func readHTTPFile(fileURL string, repo string, authHeader string, validators *kitValidators) ([]byte, error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request: %v", err)
+	}
+	if validators.ETag != "" {
+		req.Header.Set("If-None-Match", validators.ETag)
+	}
+	if validators.LastModified != "" {
+		req.Header.Set("If-Modified-Since", validators.LastModified)
+	}
+	if authHeader == "" {
+		addAuthHeader(req, repo)
+	} else if credential := findCredential(repo); credential != nil && credential.Token != "" && req.URL.Scheme == "https" {
+		req.Header.Set(authHeader, expandSecrets(credential.Token))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error making request: %v", err)
+	}
+	defer resp.Body.Close()
+	validators.RetryAfter = getRateLimitReset(resp)
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error: HTTP status %d for %s", resp.StatusCode, fileURL)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response body: %v", err)
+	}
+	validators.ETag = resp.Header.Get("ETag")
+	validators.LastModified = resp.Header.Get("Last-Modified")
+	return body, nil
+}
+
+// getRateLimitReset returns until when the server asked not to be called again, from the
+// Retry-After header or an exhausted X-RateLimit-Remaining. It is zero if there is no limit.
+func getRateLimitReset(resp *http.Response) time.Time {
+	if retryAfter := resp.Header.Get("Retry-After"); retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil {
+			return time.Now().Add(time.Duration(seconds) * time.Second)
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return date
+		}
+	}
+	if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+			return time.Unix(reset, 0)
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// detached signature published next to the kit list
+var kitSignatureFile = kitListFile + ".sig"
+
+// trust states of a kit list
+var (
+	kitTrustVerified = "verified" // signed by one of the trusted keys of the repository
+	kitTrustUnsigned = "unsigned" // no signature, or no trusted key to check it against
+	kitTrustInvalid  = "invalid"  // the signature doesn't match the list, it was tampered with or signed by another key
+)
+
+// getKitTrustPolicy returns what happens to kits that aren't verified: off ignores signatures,
+// flag reports them and reject also refuses to add or install them
+func getKitTrustPolicy() string {
+	switch policy := strings.ToLower(CurrentConfig.KitTrustPolicy); policy {
+	case "off", "reject":
+		return policy
+	}
+	return "flag"
+}
+
+// verifyKitList checks the detached signature of a kit list against the trusted keys of its repository.
+// It returns the trust state and, when verified, the key that signed the list.
+func verifyKitList(repo KitRepository, content []byte, signature []byte) (string, string) {
+	if len(bytes.TrimSpace(signature)) == 0 || len(repo.TrustedKeys) == 0 {
+		return kitTrustUnsigned, ""
+	}
+	sig := decodeSignature(signature)
+	if sig == nil {
+		logToMainFile(fmt.Sprintf("Signature of the kits list from %s is malformed", repo.Location))
+		return kitTrustInvalid, ""
+	}
+	for _, key := range repo.TrustedKeys {
+		publicKey, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key))
+		if err != nil || len(publicKey) != ed25519.PublicKeySize {
+			logToMainFile(fmt.Sprintf("Ignoring malformed trusted key %s of %s", key, repo.Location))
+			continue
+		}
+		if ed25519.Verify(ed25519.PublicKey(publicKey), content, sig) {
+			return kitTrustVerified, key
+		}
+	}
+	logToMainFile(fmt.Sprintf("Signature of the kits list from %s doesn't match any trusted key", repo.Location))
+	return kitTrustInvalid, ""
+}
+
+// decodeSignature accepts a base64 encoded or raw ed25519 signature
+func decodeSignature(signature []byte) []byte {
+	if decoded, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(signature))); err == nil && len(decoded) == ed25519.SignatureSize {
+		return decoded
+	}
+	if len(signature) == ed25519.SignatureSize {
+		return signature
+	}
+	return nil
+}
+
+// readKitSignature reads the signature of the kit list, a missing signature is empty
+func readKitSignature(repo KitRepository) []byte {
+	source, err := newKitSource(repo)
+	if err != nil {
+		return nil
+	}
+	signature, err := source.ReadFile(kitSignatureFile)
+	if err != nil {
+		return nil
+	}
+	return signature
+}
+
+// kitTrustNeedsCheck tells if the signature of an unchanged list has to be read again: one may have
+// been published since, or the key that signed it may no longer be trusted
+func kitTrustNeedsCheck(repo KitRepository, trust string, signedBy string) bool {
+	switch trust {
+	case "":
+		return true
+	case kitTrustVerified:
+		for _, key := range repo.TrustedKeys {
+			if strings.TrimSpace(key) == strings.TrimSpace(signedBy) {
+				return false
+			}
+		}
+		return true
+	}
+	// without trusted keys nothing can be verified
+	return len(repo.TrustedKeys) > 0
+}
+
+// applyTrustPolicy returns the kit as the catalog shows it, with an error if the policy rejects it
+func (kit Kit) applyTrustPolicy() Kit {
+	if kit.Trust == kitTrustVerified || getKitTrustPolicy() != "reject" {
+		return kit
+	}
+	kit.Errors = append(append([]string{}, kit.Errors...), fmt.Sprintf("kit list is %s and the trust policy rejects it", kit.Trust))
+	return kit
+}
+
+// checkKitAllowed refuses applications coming from a kit that failed validation or the trust policy.
+// When the policy rejects unverified kits, applications that don't come from a catalog kit are refused too.
+func (subApp *SubApplication) checkKitAllowed() error {
+	kit := subApp.getKitFor()
+	if kit == nil {
+		if getKitTrustPolicy() == "reject" {
+			return fmt.Errorf("application %s doesn't come from a catalog kit and the trust policy rejects it", subApp.Name)
+		}
+		return nil
+	}
+	if !kit.isValid() {
+		return fmt.Errorf("kit %s can't be used: %s", kit.Name, strings.Join(kit.Errors, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// fields of a subapplication that come from its kit and can be upgraded.
+// The install path and the runtime state are left alone.
+var kitDefinitionFields = []string{
+	"name", "commandExec", "command", "restartOnCriticalError", "criticalErrorMessages", "autoStart",
+	"repoURL", "branch", "autoUpdate", "flags", "appType", "setupSteps", "symLinks", "python",
+	"updatePolicy", "blueGreen", "requirements",
+}
+
+// KitUpgrade describes how a newer kit definition merges into an installed application
+type KitUpgrade struct {
+	AppId       string           `json:"appId"`
+	KitId       string           `json:"kitId"`
+	FromVersion string           `json:"fromVersion"`
+	ToVersion   string           `json:"toVersion"`
+	Changes     []KitFieldChange `json:"changes"`
+}
+
+// KitFieldChange is a field the kit changed since the application was created
+type KitFieldChange struct {
+	Field  string      `json:"field"`
+	Base   interface{} `json:"base"`   // Value of the kit the application was created from
+	Local  interface{} `json:"local"`  // Value of the application
+	Kit    interface{} `json:"kit"`    // Value of the new kit
+	Merged interface{} `json:"merged"` // Value the upgrade applies
+	Status string      `json:"status"` // upstream: taken from the kit, merged: combined with local changes, conflict: local value kept
+}
+
+// KitUpgradeRequest applies a kit upgrade, taking the kit value for the listed conflicting fields
+type KitUpgradeRequest struct {
+	Take []string `json:"take"`
+}
+
+// getKitDefinition returns the upgradable fields of the application as generic JSON values
+func getKitDefinition(subApp *SubApplication) map[string]interface{} {
+	return getDefinition(subApp, kitDefinitionFields)
+}
+
+// getDefinition returns the given fields of the application as generic JSON values
+func getDefinition(subApp *SubApplication, fields []string) map[string]interface{} {
+	definition := make(map[string]interface{})
+	// compare setup steps in their normalized form, without touching the steps of the original
+	normalized := *subApp
+	normalized.SetupSteps = append([]SetupStep(nil), subApp.SetupSteps...)
+	normalized.normalizeSetupSteps()
+	encoded, err := json.Marshal(&normalized)
+	if err != nil {
+		return definition
+	}
+	var all map[string]interface{}
+	if json.Unmarshal(encoded, &all) != nil {
+		return definition
+	}
+	for _, field := range fields {
+		definition[field] = all[field]
+	}
+	return definition
+}
+
+// trackKit records the kit the application is created from, used as the base of later upgrades
+func (subApp *SubApplication) trackKit(kit *Kit, definition *SubApplication) {
+	subApp.KitId = kit.Id
+	subApp.KitVersion = kit.Version
+	subApp.KitBase = getKitDefinition(definition)
+	subApp.KitUpgrade = ""
+}
+
+// getKitFor returns the kit the application comes from, kits added before tracking are found by id
+func (subApp *SubApplication) getKitFor() *Kit {
+	if subApp.KitId != "" {
+		return findKit(subApp.KitId)
+	}
+	return findKit(subApp.Id)
+}
+
+// renderFor returns the kit definition as it applies to the application, with its parameters
+func (kit *Kit) renderFor(subApp *SubApplication) (*SubApplication, error) {
+	if len(kit.Parameters) == 0 {
+		definition := kit.SubApplication
+		return &definition, nil
+	}
+	values := make(map[string]string)
+	for _, param := range kit.Parameters {
+		if value, ok := subApp.Parameters[param.Name]; ok {
+			values[param.Name] = value
+		}
+	}
+	return kit.render(values)
+}
+
+// getKitUpgrade computes the field level merge of the current kit into the application.
+// It returns nil if the kit didn't change since the application was created.
+func (subAppDef *SubApplication) getKitUpgrade() (*KitUpgrade, error) {
+	subApp := subAppDef.getCurrent()
+	if subApp == nil {
+		return nil, fmt.Errorf("invalid app")
+	}
+	upgrade, _, _, err := subApp.resolveKitUpgrade()
+	return upgrade, err
+}
+
+// resolveKitUpgrade computes the upgrade of the application along with the kit and the rendered
+// definition it was computed from, so applying it doesn't look the kit up again
+func (subApp *SubApplication) resolveKitUpgrade() (*KitUpgrade, *Kit, *SubApplication, error) {
+	kit := subApp.getKitFor()
+	if kit == nil {
+		return nil, nil, nil, fmt.Errorf("application %s doesn't come from a known kit", subApp.Name)
+	}
+	if !kit.isValid() {
+		return nil, nil, nil, fmt.Errorf("kit %s can't be used: %s", kit.Name, strings.Join(kit.Errors, "; "))
+	}
+	rendered, err := kit.renderFor(subApp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	base := subApp.KitBase
+	local := getKitDefinition(subApp)
+	upstream := getKitDefinition(rendered)
+	upgrade := &KitUpgrade{AppId: subApp.Id, KitId: kit.Id, FromVersion: subApp.KitVersion, ToVersion: kit.Version}
+	for _, field := range kitDefinitionFields {
+		var baseValue interface{}
+		if base != nil {
+			baseValue = base[field]
+			if reflect.DeepEqual(baseValue, upstream[field]) {
+				// the kit didn't touch the field, whatever the application has stays
+				continue
+			}
+		}
+		if reflect.DeepEqual(local[field], upstream[field]) {
+			continue
+		}
+		merged, conflict := mergeKitValue(field, baseValue, local[field], upstream[field], base != nil)
+		change := KitFieldChange{Field: field, Base: baseValue, Local: local[field], Kit: upstream[field], Merged: merged, Status: "merged"}
+		if conflict {
+			change.Status = "conflict"
+		} else if reflect.DeepEqual(merged, upstream[field]) {
+			change.Status = "upstream"
+		}
+		upgrade.Changes = append(upgrade.Changes, change)
+	}
+	if len(upgrade.Changes) == 0 && (kit.Version == "" || kit.Version == subApp.KitVersion) {
+		return nil, kit, rendered, nil
+	}
+	return upgrade, kit, rendered, nil
+}
+
+// mergeKitValue merges a field three ways. Maps are merged key by key and lists item by item,
+// other values conflict when both the application and the kit changed them, keeping the local one.
+// Without a known base nothing is known about local changes, so lists and maps only gain entries.
+func mergeKitValue(field string, base interface{}, local interface{}, upstream interface{}, hasBase bool) (interface{}, bool) {
+	if hasBase && reflect.DeepEqual(base, local) {
+		return upstream, false
+	}
+	localMap, localIsMap := local.(map[string]interface{})
+	upstreamMap, upstreamIsMap := upstream.(map[string]interface{})
+	if localIsMap && upstreamIsMap {
+		baseMap, _ := base.(map[string]interface{})
+		merged := make(map[string]interface{})
+		conflict := false
+		for key, value := range localMap {
+			merged[key] = value
+		}
+		for key, value := range upstreamMap {
+			baseValue, inBase := baseMap[key]
+			localValue, inLocal := localMap[key]
+			switch {
+			case !inLocal && !inBase:
+				merged[key] = value
+			case inLocal && inBase && reflect.DeepEqual(localValue, baseValue):
+				merged[key] = value
+			case inLocal && !reflect.DeepEqual(localValue, value) && (!inBase || !reflect.DeepEqual(baseValue, value)):
+				conflict = true
+			}
+		}
+		for key, baseValue := range baseMap {
+			if _, inUpstream := upstreamMap[key]; !inUpstream && reflect.DeepEqual(localMap[key], baseValue) {
+				delete(merged, key)
+			}
+		}
+		return merged, conflict
+	}
+	localList, localIsList := local.([]interface{})
+	upstreamList, upstreamIsList := upstream.([]interface{})
+	if (localIsList || local == nil) && upstreamIsList {
+		baseList, _ := base.([]interface{})
+		return mergeKitList(field, baseList, localList, upstreamList), false
+	}
+	return local, true
+}
+
+// mergeKitList keeps the local items, adds the items the kit added and drops the ones it removed.
+// Flags are matched by option name so a locally changed value of an option is kept.
+func mergeKitList(field string, base []interface{}, local []interface{}, upstream []interface{}) []interface{} {
+	key := func(item interface{}) string {
+		encoded, _ := json.Marshal(item)
+		if text, ok := item.(string); ok && field == "flags" {
+			if parts := strings.Fields(text); len(parts) > 0 {
+				return strings.SplitN(parts[0], "=", 2)[0]
+			}
+		}
+		return string(encoded)
+	}
+	contains := func(list []interface{}, item interface{}) bool {
+		for _, existing := range list {
+			if key(existing) == key(item) {
+				return true
+			}
+		}
+		return false
+	}
+	merged := []interface{}{}
+	for _, item := range local {
+		removed := contains(base, item) && !contains(upstream, item)
+		if !removed {
+			merged = append(merged, item)
+		}
+	}
+	for _, item := range upstream {
+		if !contains(base, item) && !contains(merged, item) {
+			merged = append(merged, item)
+		}
+	}
+	return merged
+}
+
+// applyKitUpgrade merges the current kit into the application, keeping local overrides.
+// Conflicting fields keep the local value unless they are listed in take, actor is recorded in the history.
+func (subAppDef *SubApplication) applyKitUpgrade(request KitUpgradeRequest, actor string) (*SubApplication, error) {
+	subApp := subAppDef.getCurrent()
+	if subApp == nil {
+		return nil, fmt.Errorf("invalid app")
+	}
+	upgrade, kit, rendered, err := subApp.resolveKitUpgrade()
+	if err != nil {
+		return nil, err
+	}
+	if upgrade != nil && len(upgrade.Changes) > 0 {
+		values := make(map[string]interface{})
+		for _, change := range upgrade.Changes {
+			values[change.Field] = change.Merged
+			for _, field := range request.Take {
+				if field == change.Field {
+					values[change.Field] = change.Kit
+				}
+			}
+		}
+		encoded, err := json.Marshal(values)
+		if err != nil {
+			return nil, err
+		}
+		var check SubApplication
+		err = json.Unmarshal(encoded, &check)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply kit upgrade: %v", err)
+		}
+		// lists and maps are replaced, not merged into
+		for field := range values {
+			if value, ok := getSubApplicationField(subApp, field); ok {
+				value.Set(reflect.Zero(value.Type()))
+			}
+		}
+		err = json.Unmarshal(encoded, subApp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to apply kit upgrade: %v", err)
+		}
+		subApp.normalizeSetupSteps()
+		changed := []string{}
+		for field := range values {
+			changed = append(changed, field)
+		}
+		sort.Strings(changed)
+		logToFile("log", fmt.Sprintf("Applied kit upgrade to %s, changed %s", kit.Version, strings.Join(changed, ", ")), subApp, true)
+	}
+	subApp.trackKit(kit, rendered)
+	saveSubApplicationsAs(actor, fmt.Sprintf("kit upgrade of %s to version %s", subApp.Id, kit.Version))
+	if installLoc, err := getInstallLocation(subApp); err == nil && subApp.Installed {
+		subApp.checkSymLinks(installLoc)
+	}
+	broadcastToSocket("subapplications", subApplications)
+	return subApp, nil
+}
+
+// checkKitUpgrades flags the applications whose kit has a newer definition
+func checkKitUpgrades() {
+	changed := false
+	for _, subApp := range subApplications {
+		available := ""
+		upgrade, err := subApp.getKitUpgrade()
+		if err == nil && upgrade != nil {
+			available = upgrade.ToVersion
+			if available == "" {
+				available = "changed"
+			}
+		}
+		if subApp.KitUpgrade != available {
+			subApp.KitUpgrade = available
+			changed = true
+		}
+	}
+	if changed {
+		saveSubApplications()
+		broadcastToSocket("appstates", getStates(subApplications))
+	}
+}
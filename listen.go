@@ -0,0 +1,235 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"time"
+)
+
+// files the self-signed certificate is generated in, next to the executable
+var (
+	selfSignedCertFile = filepath.Join("tls", "cert.pem")
+	selfSignedKeyFile  = filepath.Join("tls", "key.pem")
+)
+
+// fields of the configuration the API is bound with, changing them only takes effect after a restart
+var listenerConfigFields = []string{"listenAddress", "listenAddresses", "tlsCertFile", "tlsKeyFile", "tlsSelfSigned", "controlSocket"}
+
+// values of the listener fields the API was bound with, nil until it is
+var boundConfig map[string]interface{}
+
+// listenAll binds every configured address and the control socket, so the caller knows the API
+// is reachable before anything else starts. Nothing stays bound if one of them fails, and having
+// nothing to bind is an error too.
+func listenAll() ([]net.Listener, error) {
+	tlsConfig, err := getTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	listeners := []net.Listener{}
+	closeAll := func() {
+		for _, listener := range listeners {
+			listener.Close()
+		}
+	}
+	for _, address := range getListenAddresses() {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to listen on %s: %v", address, err)
+		}
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		}
+		logToMainFile(fmt.Sprintf("Listening on %s (%s)", address, getScheme(tlsConfig)))
+		listeners = append(listeners, listener)
+	}
+	if CurrentConfig.ControlSocket != "" {
+		listener, err := listenControlSocket(CurrentConfig.ControlSocket)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		listeners = append(listeners, listener)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no listen address or control socket is configured")
+	}
+	boundConfig = getListenerConfig(CurrentConfig)
+	return listeners, nil
+}
+
+// getListenerConfig returns the values of the listener fields of config
+func getListenerConfig(config Config) map[string]interface{} {
+	values := make(map[string]interface{})
+	for _, name := range listenerConfigFields {
+		if field, ok := getConfigField(&config, name); ok {
+			values[name] = field.Interface()
+		}
+	}
+	return values
+}
+
+// getRestartRequired returns the listener fields changed since the API was bound, they only
+// take effect after a restart
+func getRestartRequired() []string {
+	fields := []string{}
+	if boundConfig == nil {
+		return fields
+	}
+	current := getListenerConfig(CurrentConfig)
+	for _, name := range listenerConfigFields {
+		if !reflect.DeepEqual(current[name], boundConfig[name]) {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
+
+// serveAll serves the API on every listener, until they are closed
+func serveAll(listeners []net.Listener, handler http.Handler) {
+	server := &http.Server{Handler: handler}
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			err := server.Serve(listener)
+			if err != nil && err != http.ErrServerClosed {
+				logToMainFile(fmt.Sprintf("Stopped serving on %s: %v", listener.Addr(), err))
+			}
+		}(listener)
+	}
+}
+
+// getListenAddresses returns the listen address followed by the additional ones, without duplicates
+func getListenAddresses() []string {
+	addresses := []string{}
+	seen := make(map[string]bool)
+	for _, address := range append([]string{CurrentConfig.ListenAddress}, CurrentConfig.ListenAddresses...) {
+		if address != "" && !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+func getScheme(tlsConfig *tls.Config) string {
+	if tlsConfig != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// getTLSConfig returns the TLS configuration of the API, nil for plain HTTP. The configured certificate
+// is used if there is one, otherwise a self-signed one is generated on first run if enabled.
+func getTLSConfig() (*tls.Config, error) {
+	certFile, keyFile := CurrentConfig.TLSCertFile, CurrentConfig.TLSKeyFile
+	if certFile == "" && keyFile == "" {
+		if !CurrentConfig.TLSSelfSigned {
+			return nil, nil
+		}
+		exPath, err := getCurrentPath()
+		if err != nil {
+			return nil, err
+		}
+		certFile, keyFile = filepath.Join(exPath, selfSignedCertFile), filepath.Join(exPath, selfSignedKeyFile)
+		if _, err := os.Stat(certFile); os.IsNotExist(err) {
+			err = generateSelfSignedCertificate(certFile, keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to generate a self-signed certificate: %v", err)
+			}
+		}
+	} else if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("tlsCertFile and tlsKeyFile must be set together")
+	}
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the TLS certificate %s: %v", certFile, err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{certificate}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// generateSelfSignedCertificate creates a certificate for localhost and the name of the machine,
+// its fingerprint is logged so clients can pin it
+func generateSelfSignedCertificate(certFile string, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" {
+		names = append(names, hostname)
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: serviceName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              names,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return err
+	}
+	fingerprint := sha256.Sum256(der)
+	logToMainFile(fmt.Sprintf("Generated a self-signed certificate %s, SHA-256 fingerprint %s", certFile, hex.EncodeToString(fingerprint[:])))
+	return nil
+}
+
+// listenControlSocket listens on a unix domain socket for local control, relative paths are next
+// to the executable. A socket left behind by a previous run is replaced.
+func listenControlSocket(path string) (net.Listener, error) {
+	if !filepath.IsAbs(path) {
+		exPath, err := getCurrentPath()
+		if err != nil {
+			return nil, err
+		}
+		path = filepath.Join(exPath, path)
+	}
+	if _, err := os.Stat(path); err == nil {
+		if connection, err := net.Dial("unix", path); err == nil {
+			connection.Close()
+			return nil, fmt.Errorf("control socket %s is in use by another process", path)
+		}
+		os.Remove(path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket %s: %v", path, err)
+	}
+	logToMainFile(fmt.Sprintf("Listening on control socket %s", path))
+	return listener, nil
+}
@@ -40,6 +40,7 @@ func logMessage(subAppDir string, name string, prefix string, message string) st
 }
 
 func logToFile(logType string, message string, subApp *SubApplication, logFlags ...bool) {
+	message = redactSecrets(message)
 	func() {
 		var location string
 		var app string = "daemon"
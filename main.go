@@ -15,6 +15,9 @@ var serviceName = "MrG.Daemon"
 var niceServiceName = "Mr.G Daemon"
 
 func main() {
+	// started before anything logs, logging broadcasts and would block without it
+	go broadcastMessages()
+	parseCommandLine(os.Args[1:])
 	isWinService, err := svc.IsWindowsService()
 	if err != nil {
 		log.Fatalf("failed to determine if we are running in an interactive session: %v", err)
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+// folder, inside the data folder, holding the bare mirrors of the git sources
+var mirrorsFolder = ".mirrors"
+
+// mirrors refreshed more recently than this are not fetched again
+var mirrorFreshness = time.Minute
+
+// mirrorState serializes the refreshes of one mirror, the others are refreshed meanwhile
+type mirrorState struct {
+	mu        sync.Mutex
+	refreshed time.Time
+}
+
+var mirrorsMu sync.Mutex
+var mirrors = make(map[string]*mirrorState)
+
+// mirrorRefSpecs copy the branches and tags of the remote as they are
+var mirrorRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+var unsafeMirrorChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// useMirrors checks if git sources go through the mirror cache
+func useMirrors() bool {
+	return !CurrentConfig.DisableMirrorCache
+}
+
+// getMirrorLocation returns the bare mirror used for the remote
+func getMirrorLocation(remote string) (string, error) {
+	dataLoc, err := getDataLocation()
+	if err != nil {
+		return "", err
+	}
+	folder, _, err := getFolderWithCreate(dataLoc, mirrorsFolder)
+	if err != nil {
+		return "", err
+	}
+	name := unsafeMirrorChars.ReplaceAllString(normalizeRemote(remote), "_")
+	if name == "" {
+		return "", fmt.Errorf("invalid remote %s", remote)
+	}
+	return filepath.Join(folder, name+".git"), nil
+}
+
+// refreshMirror creates or updates the bare mirror of the remote and returns its location.
+// When the remote can't be reached an existing mirror is used as it is, so installs work offline.
+// Mirrors are never garbage collected, the repositories borrowing their objects rely on that.
+func refreshMirror(remote string) (string, error) {
+	mirrorLoc, err := getMirrorLocation(remote)
+	if err != nil {
+		return "", err
+	}
+	state := getMirrorState(mirrorLoc)
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	if time.Since(state.refreshed) < mirrorFreshness {
+		return mirrorLoc, nil
+	}
+
+	mirror, err := git.PlainOpen(mirrorLoc)
+	created := false
+	if err == git.ErrRepositoryNotExists {
+		mirror, err = git.PlainInit(mirrorLoc, true)
+		if err != nil {
+			return "", fmt.Errorf("failed to create mirror %s: %v", mirrorLoc, err)
+		}
+		_, err = mirror.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote}, Fetch: mirrorRefSpecs})
+		if err != nil {
+			os.RemoveAll(mirrorLoc)
+			return "", fmt.Errorf("failed to configure mirror %s: %v", mirrorLoc, err)
+		}
+		created = true
+	} else if err != nil {
+		return "", fmt.Errorf("failed to open mirror %s: %v", mirrorLoc, err)
+	}
+
+	logToMainFile(fmt.Sprintf("Refreshing mirror of %s", remote))
+	err = mirror.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       authForRemote(remote),
+		Progress:   os.Stdout,
+		Tags:       git.NoTags,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		if created {
+			os.RemoveAll(mirrorLoc)
+			return "", fmt.Errorf("failed to fetch %s: %v", remote, err)
+		}
+		logToMainFile(fmt.Sprintf("Failed to refresh mirror of %s, using the cached copy: %v", remote, err))
+		return mirrorLoc, nil
+	}
+	setMirrorHead(mirror, remote)
+	state.refreshed = time.Now()
+	return mirrorLoc, nil
+}
+
+// getMirrorState returns the lock and freshness of a mirror
+func getMirrorState(mirrorLoc string) *mirrorState {
+	mirrorsMu.Lock()
+	defer mirrorsMu.Unlock()
+	state, ok := mirrors[mirrorLoc]
+	if !ok {
+		state = &mirrorState{}
+		mirrors[mirrorLoc] = state
+	}
+	return state
+}
+
+// fetchInMemory fetches the branches and tags of the remote into memory, laid out like a mirror,
+// for reading files without keeping a copy on disk
+func fetchInMemory(remote string) (*git.Repository, error) {
+	repo, err := git.Init(memory.NewStorage(), nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote}, Fetch: mirrorRefSpecs})
+	if err != nil {
+		return nil, err
+	}
+	err = repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       authForRemote(remote),
+		Tags:       git.NoTags,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, fmt.Errorf("failed to fetch %s: %v", remote, err)
+	}
+	setMirrorHead(repo, remote)
+	return repo, nil
+}
+
+// setMirrorHead points the mirror HEAD to the default branch of the remote
+func setMirrorHead(mirror *git.Repository, remote string) {
+	origin, err := mirror.Remote("origin")
+	if err != nil {
+		return
+	}
+	refs, err := origin.List(&git.ListOptions{Auth: authForRemote(remote)})
+	if err != nil {
+		return
+	}
+	var head *plumbing.Reference
+	for _, ref := range refs {
+		if ref.Name() == plumbing.HEAD {
+			head = ref
+		}
+	}
+	if head == nil {
+		return
+	}
+	target := head.Target()
+	if head.Type() != plumbing.SymbolicReference {
+		target = ""
+		for _, ref := range refs {
+			if ref.Name().IsBranch() && ref.Hash() == head.Hash() {
+				target = ref.Name()
+				break
+			}
+		}
+	}
+	if target != "" {
+		mirror.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, target))
+	}
+}
+
+// borrowFromMirror makes repo read missing objects from the mirror and copies the mirror
+// branches and tags as the origin references of repo. It returns git.NoErrAlreadyUpToDate
+// if no reference changed.
+func borrowFromMirror(repo *git.Repository, repoLoc string, mirrorLoc string) error {
+	alternates := filepath.Join(repoLoc, "objects", "info", "alternates")
+	objects := filepath.Join(mirrorLoc, "objects")
+	content, err := ioutil.ReadFile(alternates)
+	if err != nil || !strings.Contains(string(content), objects) {
+		err = os.MkdirAll(filepath.Dir(alternates), os.ModePerm)
+		if err != nil {
+			return err
+		}
+		err = ioutil.WriteFile(alternates, []byte(strings.TrimSpace(string(content)+"\n"+objects)+"\n"), 0644)
+		if err != nil {
+			return fmt.Errorf("failed to link mirror objects: %v", err)
+		}
+	}
+
+	mirror, err := git.PlainOpen(mirrorLoc)
+	if err != nil {
+		return fmt.Errorf("failed to open mirror %s: %v", mirrorLoc, err)
+	}
+	refs, err := mirror.References()
+	if err != nil {
+		return err
+	}
+	changed := false
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		var name plumbing.ReferenceName
+		if ref.Name().IsBranch() {
+			name = plumbing.NewRemoteReferenceName("origin", ref.Name().Short())
+		} else if ref.Name().IsTag() {
+			name = ref.Name()
+		} else {
+			return nil
+		}
+		existing, err := repo.Storer.Reference(name)
+		if err == nil && existing.Hash() == ref.Hash() {
+			return nil
+		}
+		changed = true
+		return repo.Storer.SetReference(plumbing.NewHashReference(name, ref.Hash()))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to copy mirror references: %v", err)
+	}
+	if !changed {
+		return git.NoErrAlreadyUpToDate
+	}
+	return nil
+}
+
+// getGitDir returns the folder holding the objects of a repository opened from the filesystem
+func getGitDir(repo *git.Repository) (string, error) {
+	storage, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return "", fmt.Errorf("repository is not stored on disk")
+	}
+	return storage.Filesystem().Root(), nil
+}
+
+// cloneFromMirror clones remote into dir through its mirror, borrowing the objects instead of copying them
+func cloneFromMirror(dir string, remote string, branch string) (*git.Repository, error) {
+	mirrorLoc, err := refreshMirror(remote)
+	if err != nil {
+		return nil, err
+	}
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remote}})
+	if err != nil {
+		return nil, err
+	}
+	err = borrowFromMirror(repo, filepath.Join(dir, git.GitDirName), mirrorLoc)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+	if branch == "" {
+		mirror, err := git.PlainOpen(mirrorLoc)
+		if err != nil {
+			return nil, err
+		}
+		head, err := mirror.Storer.Reference(plumbing.HEAD)
+		if err != nil || head.Type() != plumbing.SymbolicReference {
+			return nil, fmt.Errorf("default branch of %s is unknown", remote)
+		}
+		branch = head.Target().Short()
+	}
+	remoteRef, err := repo.Storer.Reference(plumbing.NewRemoteReferenceName("origin", branch))
+	if err != nil {
+		return nil, fmt.Errorf("branch %s not found in %s: %v", branch, remote, err)
+	}
+	branchRef := plumbing.NewBranchReferenceName(branch)
+	err = repo.Storer.SetReference(plumbing.NewHashReference(branchRef, remoteRef.Hash()))
+	if err != nil {
+		return nil, err
+	}
+	err = repo.CreateBranch(&config.Branch{Name: branch, Remote: "origin", Merge: branchRef})
+	if err != nil {
+		return nil, err
+	}
+	err = repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branchRef))
+	if err != nil {
+		return nil, err
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		return nil, err
+	}
+	err = w.Reset(&git.ResetOptions{Commit: remoteRef.Hash(), Mode: git.HardReset})
+	if err != nil {
+		return nil, fmt.Errorf("failed to checkout %s: %v", branch, err)
+	}
+	return repo, nil
+}
+
+// fetchFromMirror refreshes the mirror of the origin of repo and copies its references
+func fetchFromMirror(repo *git.Repository) error {
+	mirrorLoc, err := refreshMirror(originURL(repo))
+	if err != nil {
+		return err
+	}
+	gitDir, err := getGitDir(repo)
+	if err != nil {
+		return err
+	}
+	return borrowFromMirror(repo, gitDir, mirrorLoc)
+}
+
+// fastForward moves the current branch to origin/branch, like a pull that doesn't fetch
+func fastForward(repo *git.Repository, w *git.Worktree, branch string) error {
+	remoteRef, err := repo.Storer.Reference(plumbing.NewRemoteReferenceName("origin", branch))
+	if err != nil {
+		return err
+	}
+	head, err := repo.Head()
+	if err == nil {
+		if head.Hash() == remoteRef.Hash() {
+			return git.NoErrAlreadyUpToDate
+		}
+		ff, err := isAncestor(repo, head.Hash(), remoteRef.Hash())
+		if err != nil {
+			return err
+		}
+		if !ff {
+			return git.ErrNonFastForwardUpdate
+		}
+	}
+	headRef, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+	name := plumbing.HEAD
+	if headRef.Type() == plumbing.SymbolicReference {
+		name = headRef.Target()
+	}
+	err = repo.Storer.SetReference(plumbing.NewHashReference(name, remoteRef.Hash()))
+	if err != nil {
+		return err
+	}
+	return w.Reset(&git.ResetOptions{Commit: remoteRef.Hash(), Mode: git.MergeReset})
+}
+
+// isAncestor checks if ancestor is reachable from commit
+func isAncestor(repo *git.Repository, ancestor plumbing.Hash, commit plumbing.Hash) (bool, error) {
+	start, err := repo.CommitObject(commit)
+	if err != nil {
+		return false, err
+	}
+	found := false
+	err = object.NewCommitPreorderIter(start, nil, nil).ForEach(func(c *object.Commit) error {
+		if c.Hash == ancestor {
+			found = true
+			return storer.ErrStop
+		}
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// folder, next to the executable, holding the custom node manifests of the applications
+var nodesFolder = "nodes"
+
+// suffix ComfyUI uses to ignore a custom node folder
+var disabledNodeSuffix = ".disabled"
+
+// CustomNode is a ComfyUI custom node installed in an application
+type CustomNode struct {
+	Name        string `json:"name"`        // Folder name under custom_nodes
+	RepoURL     string `json:"repoURL"`     // URL of the repository
+	Branch      string `json:"branch"`      // Branch to follow, default branch if empty
+	Commit      string `json:"commit"`      // Commit the node is pinned to
+	Enabled     bool   `json:"enabled"`     // Indicates if ComfyUI loads the node
+	InstalledAt string `json:"installedAt"` // When the node was installed
+	UpdatedAt   string `json:"updatedAt"`   // When the node was last updated
+}
+
+// NodeManifest lists the custom nodes installed in an application
+type NodeManifest struct {
+	AppId string        `json:"appId"`
+	Nodes []*CustomNode `json:"nodes"`
+}
+
+// NodeRequest is an operation on the custom nodes of an application
+type NodeRequest struct {
+	Action  string `json:"action"`  // install, update, enable, disable, remove or sync, empty to list
+	Name    string `json:"name"`    // Name of the node, derived from the repository if empty
+	RepoURL string `json:"repoURL"` // Repository to install from
+	Branch  string `json:"branch"`  // Branch to follow
+	Commit  string `json:"commit"`  // Commit to pin, latest if empty
+}
+
+// supportsCustomNodes checks if the application is a ComfyUI based one
+func (subApp *SubApplication) supportsCustomNodes() bool {
+	return subApp.AppType == "comfy" || subApp.AppType == "mrg"
+}
+
+// getCustomNodesLocation returns the custom_nodes folder of the application installed in installLoc
+func (subApp *SubApplication) getCustomNodesLocation(installLoc string) (string, error) {
+	// kits bundle ComfyUI in a subfolder, plain ComfyUI checkouts have it at the root
+	candidates := []string{filepath.Join(installLoc, "ComfyUI", "custom_nodes"), filepath.Join(installLoc, "custom_nodes")}
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && info.IsDir() {
+			return candidate, nil
+		}
+	}
+	folder := candidates[1]
+	if subApp.AppType == "mrg" {
+		folder = candidates[0]
+	}
+	folder, _, err := getFolderWithCreate(folder)
+	return folder, err
+}
+
+// getNodeManifestFile returns the name the manifest of the application is stored under
+func getNodeManifestFile(appId string) string {
+	return nodesFolder + "/" + appId
+}
+
+// readNodeManifest reads the custom node manifest of the application, empty if there is none
+func readNodeManifest(appId string) (*NodeManifest, error) {
+	manifest := &NodeManifest{AppId: appId}
+	content, err := getStateStore().Read(getNodeManifestFile(appId))
+	if os.IsNotExist(err) {
+		return manifest, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(content, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding node manifest: %v", err)
+	}
+	return manifest, nil
+}
+
+// saveNodeManifest saves the manifest and notifies the clients
+func saveNodeManifest(manifest *NodeManifest) error {
+	content, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = getStateStore().Write(getNodeManifestFile(manifest.AppId), append(content, '\n'))
+	if err != nil {
+		return err
+	}
+	broadcastToSocket("nodes", manifest)
+	return nil
+}
+
+// removeNodeManifest deletes the manifest of an application that was uninstalled
+func removeNodeManifest(appId string) {
+	getStateStore().Remove(getNodeManifestFile(appId))
+}
+
+// isValidNodeName checks that name is a single folder under custom_nodes
+func isValidNodeName(name string) bool {
+	return isSafeRelativePath(name) && !strings.ContainsAny(name, "/\\") && name != "."
+}
+
+// find returns the node with the given name
+func (manifest *NodeManifest) find(name string) *CustomNode {
+	for _, node := range manifest.Nodes {
+		if strings.EqualFold(node.Name, name) {
+			return node
+		}
+	}
+	return nil
+}
+
+// nodeOperation runs an operation on the custom nodes of the application and returns the manifest
+func (subAppDef *SubApplication) nodeOperation(request NodeRequest) (*NodeManifest, error) {
+	subApp := subAppDef.getCurrent()
+	if subApp == nil {
+		return nil, fmt.Errorf("invalid app")
+	}
+	if !subApp.supportsCustomNodes() {
+		return nil, fmt.Errorf("application %s does not support custom nodes", subApp.Name)
+	}
+	manifest, err := readNodeManifest(subApp.Id)
+	if err != nil {
+		return nil, err
+	}
+	action := strings.ToLower(request.Action)
+	if action == "" || action == "list" {
+		defer broadcastToSocket("nodes", manifest)
+		return manifest, nil
+	}
+	installLoc, err := getInstallLocation(subApp)
+	if err != nil {
+		return nil, err
+	}
+	nodesLoc, err := subApp.getCustomNodesLocation(installLoc)
+	if err != nil {
+		return nil, err
+	}
+	if request.Name == "" && request.RepoURL != "" {
+		request.Name = strings.TrimSuffix(filepath.Base(strings.TrimRight(request.RepoURL, "/")), ".git")
+	}
+	if action != "sync" && !isValidNodeName(request.Name) {
+		return nil, fmt.Errorf("invalid custom node name %s", request.Name)
+	}
+	if action == "sync" {
+		err = subApp.syncNodes(manifest, nodesLoc, installLoc)
+	} else if action == "install" {
+		err = subApp.installNode(manifest, request, nodesLoc, installLoc)
+	} else {
+		node := manifest.find(request.Name)
+		if node == nil {
+			return nil, fmt.Errorf("custom node %s is not installed", request.Name)
+		}
+		switch action {
+		case "update":
+			err = subApp.updateNode(node, request, nodesLoc, installLoc)
+		case "enable", "disable":
+			err = node.setEnabled(nodesLoc, action == "enable")
+		case "remove":
+			err = node.remove(nodesLoc)
+			if err == nil {
+				for i, n := range manifest.Nodes {
+					if n == node {
+						manifest.Nodes = append(manifest.Nodes[:i], manifest.Nodes[i+1:]...)
+						break
+					}
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid node operation %s", request.Action)
+		}
+	}
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Custom node operation %s failed: %v", action, err), subApp, true)
+		return nil, err
+	}
+	err = saveNodeManifest(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// getLocation returns where the node currently lives, depending on whether it is enabled
+func (node *CustomNode) getLocation(nodesLoc string) string {
+	if node.Enabled {
+		return filepath.Join(nodesLoc, node.Name)
+	}
+	return filepath.Join(nodesLoc, node.Name+disabledNodeSuffix)
+}
+
+// installNode clones a custom node, pins it and installs its requirements
+func (subApp *SubApplication) installNode(manifest *NodeManifest, request NodeRequest, nodesLoc string, installLoc string) error {
+	if request.RepoURL == "" {
+		return fmt.Errorf("repository is required to install a custom node")
+	}
+	if !isValidNodeName(request.Name) {
+		return fmt.Errorf("invalid custom node name %s", request.Name)
+	}
+	if manifest.find(request.Name) != nil {
+		return fmt.Errorf("custom node %s is already installed", request.Name)
+	}
+	node := &CustomNode{
+		Name:        request.Name,
+		RepoURL:     request.RepoURL,
+		Branch:      request.Branch,
+		Commit:      request.Commit,
+		Enabled:     true,
+		InstalledAt: time.Now().Format(time.RFC3339),
+	}
+	nodeLoc := node.getLocation(nodesLoc)
+	// a folder already there belongs to someone else, only what this call cloned is removed
+	if _, err := os.Stat(nodeLoc); err == nil {
+		return fmt.Errorf("folder %s already exists", nodeLoc)
+	}
+	err := subApp.cloneNode(node, nodesLoc, installLoc)
+	if err != nil {
+		os.RemoveAll(nodeLoc)
+		return err
+	}
+	manifest.Nodes = append(manifest.Nodes, node)
+	logToFile("log", fmt.Sprintf("Installed custom node %s at %s", node.Name, node.Commit), subApp, true)
+	return nil
+}
+
+// cloneNode clones the node at its pinned commit, or the latest one if not pinned
+func (subApp *SubApplication) cloneNode(node *CustomNode, nodesLoc string, installLoc string) error {
+	nodeLoc := node.getLocation(nodesLoc)
+	if _, err := os.Stat(nodeLoc); err == nil {
+		return fmt.Errorf("folder %s already exists", nodeLoc)
+	}
+	repo, err := cloneRepository(nodeLoc, node.RepoURL, node.Branch)
+	if err != nil {
+		return fmt.Errorf("failed to clone %s: %v", node.RepoURL, err)
+	}
+	if node.Branch == "" {
+		head, err := repo.Head()
+		if err == nil && head.Name().IsBranch() {
+			node.Branch = head.Name().Short()
+		}
+	}
+	if node.Commit != "" {
+		err = checkoutCommit(repo, node.Commit)
+		if err != nil {
+			return err
+		}
+	}
+	err = initSubModules(repo, subApp)
+	if err != nil {
+		return err
+	}
+	return subApp.finishNode(node, repo, nodeLoc, installLoc)
+}
+
+// updateNode fetches the node and moves it to the requested commit, or the latest one of its branch
+func (subApp *SubApplication) updateNode(node *CustomNode, request NodeRequest, nodesLoc string, installLoc string) error {
+	nodeLoc := node.getLocation(nodesLoc)
+	repo, err := git.PlainOpen(nodeLoc)
+	if err != nil {
+		return fmt.Errorf("failed to open custom node %s: %v", node.Name, err)
+	}
+	err = fetchOrigin(repo)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return fmt.Errorf("failed to fetch custom node %s: %v", node.Name, err)
+	}
+	if request.Branch != "" {
+		node.Branch = request.Branch
+	}
+	commit := request.Commit
+	if commit == "" {
+		commit, err = latestRemoteCommit(repo, node.Branch)
+		if err != nil {
+			return err
+		}
+	}
+	err = checkoutCommit(repo, commit)
+	if err != nil {
+		return err
+	}
+	err = updateSubModules(repo, subApp)
+	if err != nil {
+		return err
+	}
+	node.UpdatedAt = time.Now().Format(time.RFC3339)
+	return subApp.finishNode(node, repo, nodeLoc, installLoc)
+}
+
+// syncNodes makes sure every node of the manifest is present at its pinned commit
+func (subApp *SubApplication) syncNodes(manifest *NodeManifest, nodesLoc string, installLoc string) error {
+	for _, node := range manifest.Nodes {
+		nodeLoc := node.getLocation(nodesLoc)
+		repo, err := git.PlainOpen(nodeLoc)
+		if err != nil {
+			logToFile("log", fmt.Sprintf("Restoring custom node %s", node.Name), subApp)
+			os.RemoveAll(nodeLoc)
+			err = subApp.cloneNode(node, nodesLoc, installLoc)
+			if err != nil {
+				return fmt.Errorf("failed to restore custom node %s: %v", node.Name, err)
+			}
+			continue
+		}
+		head, err := repo.Head()
+		if err == nil && head.Hash().String() == node.Commit {
+			continue
+		}
+		err = fetchOrigin(repo)
+		if err != nil && err != git.NoErrAlreadyUpToDate {
+			return fmt.Errorf("failed to fetch custom node %s: %v", node.Name, err)
+		}
+		err = checkoutCommit(repo, node.Commit)
+		if err != nil {
+			return err
+		}
+		err = subApp.finishNode(node, repo, nodeLoc, installLoc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreCustomNodes reinstalls the nodes of the manifest after the application was installed again
+func (subApp *SubApplication) restoreCustomNodes(installLoc string) {
+	if !subApp.supportsCustomNodes() {
+		return
+	}
+	manifest, err := readNodeManifest(subApp.Id)
+	if err != nil || len(manifest.Nodes) == 0 {
+		return
+	}
+	nodesLoc, err := subApp.getCustomNodesLocation(installLoc)
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Failed to get custom nodes location: %v", err), subApp)
+		return
+	}
+	err = subApp.syncNodes(manifest, nodesLoc, installLoc)
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Failed to restore custom nodes: %v", err), subApp, true)
+		return
+	}
+	saveNodeManifest(manifest)
+}
+
+// finishNode pins the current commit and installs the requirements of the node
+func (subApp *SubApplication) finishNode(node *CustomNode, repo *git.Repository, nodeLoc string, installLoc string) error {
+	head, err := repo.Head()
+	if err != nil {
+		return fmt.Errorf("failed to read commit of custom node %s: %v", node.Name, err)
+	}
+	node.Commit = head.Hash().String()
+	return subApp.installNodeRequirements(nodeLoc, installLoc)
+}
+
+// installNodeRequirements installs requirements.txt and runs install.py of the node with the python of the application
+func (subApp *SubApplication) installNodeRequirements(nodeLoc string, installLoc string) error {
+	python, err := subApp.pythonExecutable(installLoc)
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Skipping custom node requirements: %v", err), subApp)
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(nodeLoc, "requirements.txt")); err == nil {
+		args := []string{"-m", "pip", "install", "-r", "requirements.txt"}
+		if subApp.Python != nil {
+			args = append(args, subApp.Python.PipArgs...)
+		}
+		err = subApp.runStreamed(nodeLoc, python, args...)
+		if err != nil {
+			return fmt.Errorf("failed to install custom node requirements: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(nodeLoc, "install.py")); err == nil {
+		err = subApp.runStreamed(nodeLoc, python, "install.py")
+		if err != nil {
+			return fmt.Errorf("failed to run custom node install script: %v", err)
+		}
+	}
+	return nil
+}
+
+// setEnabled moves the node folder so ComfyUI loads or ignores it
+func (node *CustomNode) setEnabled(nodesLoc string, enabled bool) error {
+	if node.Enabled == enabled {
+		return nil
+	}
+	from := node.getLocation(nodesLoc)
+	node.Enabled = enabled
+	err := os.Rename(from, node.getLocation(nodesLoc))
+	if err != nil {
+		node.Enabled = !enabled
+		return fmt.Errorf("failed to move custom node %s: %v", node.Name, err)
+	}
+	return nil
+}
+
+// remove deletes the node folder
+func (node *CustomNode) remove(nodesLoc string) error {
+	if !isValidNodeName(node.Name) {
+		return fmt.Errorf("invalid custom node name %s", node.Name)
+	}
+	err := os.RemoveAll(node.getLocation(nodesLoc))
+	if err != nil {
+		return fmt.Errorf("failed to remove custom node %s: %v", node.Name, err)
+	}
+	return nil
+}
+
+// checkoutCommit forces the worktree to the given commit
+func checkoutCommit(repo *git.Repository, commit string) error {
+	w, err := repo.Worktree()
+	if err != nil {
+		return fmt.Errorf("failed to get worktree: %v", err)
+	}
+	err = w.Checkout(&git.CheckoutOptions{
+		Hash:  plumbing.NewHash(commit),
+		Force: true,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to checkout %s: %v", commit, err)
+	}
+	return nil
+}
+
+// latestRemoteCommit returns the commit of branch on origin, or of the remote default branch if empty
+func latestRemoteCommit(repo *git.Repository, branch string) (string, error) {
+	var refName plumbing.ReferenceName
+	if branch != "" {
+		refName = plumbing.NewRemoteReferenceName("origin", branch)
+	} else {
+		head, err := repo.Head()
+		if err != nil || !head.Name().IsBranch() {
+			return "", fmt.Errorf("branch is required, the repository is not on a branch")
+		}
+		refName = plumbing.NewRemoteReferenceName("origin", head.Name().Short())
+	}
+	ref, err := repo.Reference(refName, true)
+	if err != nil {
+		return "", fmt.Errorf("failed to find %s: %v", refName, err)
+	}
+	return ref.Hash().String(), nil
+}
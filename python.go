@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// name of the setup step that prepares the managed python environment
+var pythonStepName = "python"
+
+// name of the freeze snapshot written inside the environment
+var pythonLockFile = "requirements.lock"
+
+// first line of the snapshot, followed by the hash of the requirement files it was taken for
+var pythonLockHashPrefix = "# requirements "
+
+// PythonEnvironment configures a python virtual environment managed by the daemon
+type PythonEnvironment struct {
+	Interpreter  string   `json:"interpreter"`  // Interpreter used to create the environment, defaults to the configured one
+	Path         string   `json:"path"`         // Location of the environment, relative to the install location
+	Requirements []string `json:"requirements"` // Requirement files to install, relative to the install location
+	PipArgs      []string `json:"pipArgs"`      // Extra arguments passed to pip install
+}
+
+// PythonPackage is a package installed in a python environment
+type PythonPackage struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// PythonPackagesEvent is broadcast with the packages installed for an application
+type PythonPackagesEvent struct {
+	AppId    string          `json:"appId"`
+	Packages []PythonPackage `json:"packages"`
+}
+
+// PythonDriftEvent is broadcast when the environment no longer matches its snapshot
+type PythonDriftEvent struct {
+	AppId string   `json:"appId"`
+	Drift []string `json:"drift"`
+}
+
+// getPath returns the location of the environment inside dir
+func (env *PythonEnvironment) getPath(dir string) string {
+	path := env.Path
+	if path == "" {
+		path = "venv"
+	}
+	if filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// getRequirements returns the requirement files, defaulting to requirements.txt
+func (env *PythonEnvironment) getRequirements() []string {
+	if len(env.Requirements) > 0 {
+		return env.Requirements
+	}
+	return []string{"requirements.txt"}
+}
+
+// getInterpreter returns the interpreter used to create the environment
+func (env *PythonEnvironment) getInterpreter() string {
+	if env.Interpreter != "" {
+		return env.Interpreter
+	}
+	if CurrentConfig.PythonInterpreter != "" {
+		return CurrentConfig.PythonInterpreter
+	}
+	return "python"
+}
+
+// venvExecutable returns the python executable of a virtual environment
+func venvExecutable(venv string) string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(venv, "Scripts", "python.exe")
+	}
+	return filepath.Join(venv, "bin", "python")
+}
+
+// getPythonLocation returns the managed environment of the application installed in dir. While an
+// install is staged, the environment is built where it ends up, as environments can't be moved.
+func (subApp *SubApplication) getPythonLocation(dir string) string {
+	if subApp.pythonHome != "" {
+		return subApp.Python.getPath(subApp.pythonHome)
+	}
+	return subApp.Python.getPath(dir)
+}
+
+// pythonExecutable returns the python used by the application installed in dir,
+// the managed environment if there is one, otherwise the bundled python_embedded
+func (subApp *SubApplication) pythonExecutable(dir string) (string, error) {
+	if subApp.Python != nil {
+		return venvExecutable(subApp.getPythonLocation(dir)), nil
+	}
+	embedded := filepath.Join(dir, "python_embedded", "python.exe")
+	if _, err := os.Stat(embedded); err == nil {
+		return embedded, nil
+	}
+	return "", fmt.Errorf("application %s has no python environment", subApp.Name)
+}
+
+// getPythonStep returns the setup step that prepares the managed environment
+func (subApp *SubApplication) getPythonStep() SetupStep {
+	return SetupStep{Name: pythonStepName, SkipIfUnchanged: subApp.Python.getRequirements(), builtin: true}
+}
+
+// setupPythonEnvironment creates the environment if needed, installs the requirements and
+// writes a freeze snapshot used to detect drift. Packages of the last snapshot stay at their version
+// while the requirement files are unchanged, once they change the snapshot is taken again.
+func (subApp *SubApplication) setupPythonEnvironment(dir string) error {
+	env := subApp.Python
+	venv := subApp.getPythonLocation(dir)
+	python := venvExecutable(venv)
+	if _, err := os.Stat(python); err != nil {
+		logToFile("log", fmt.Sprintf("Creating python environment in %s", venv), subApp)
+		err = subApp.runStreamed(dir, env.getInterpreter(), "-m", "venv", venv)
+		if err != nil {
+			return fmt.Errorf("failed to create python environment: %v", err)
+		}
+	}
+	args := []string{"-m", "pip", "install"}
+	lock := filepath.Join(venv, pythonLockFile)
+	hash := hashFiles(dir, env.getRequirements())
+	if content, err := ioutil.ReadFile(lock); err == nil && readLockHash(content) == hash {
+		args = append(args, "-r", lock)
+	} else {
+		if err == nil {
+			// pins of the old requirements would conflict with the new ones
+			logToFile("log", "Requirements changed since the python environment snapshot, taking it again", subApp)
+		}
+		args = append(args, "--upgrade")
+	}
+	for _, requirements := range env.getRequirements() {
+		if _, err := os.Stat(filepath.Join(dir, requirements)); err != nil {
+			logToFile("log", fmt.Sprintf("Requirements file %s not found, skipping it", requirements), subApp)
+			continue
+		}
+		args = append(args, "-r", requirements)
+	}
+	args = append(args, env.PipArgs...)
+	err := subApp.runStreamed(dir, python, args...)
+	if err != nil {
+		return fmt.Errorf("failed to install requirements: %v", err)
+	}
+	freeze, err := runCaptured(dir, python, "-m", "pip", "freeze")
+	if err != nil {
+		return fmt.Errorf("failed to snapshot python environment: %v", err)
+	}
+	err = ioutil.WriteFile(lock, append([]byte(pythonLockHashPrefix+hash+"\n"), freeze...), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write python environment snapshot: %v", err)
+	}
+	subApp.PythonDrift = nil
+	return nil
+}
+
+// readLockHash returns the hash of the requirement files the snapshot was taken for, empty if unknown
+func readLockHash(content []byte) string {
+	line := strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+	if !strings.HasPrefix(line, pythonLockHashPrefix) {
+		return ""
+	}
+	return strings.TrimPrefix(line, pythonLockHashPrefix)
+}
+
+// checkPythonDrift compares the packages installed in the environment with the last snapshot
+func (subApp *SubApplication) checkPythonDrift(dir string) []string {
+	if subApp.Python == nil {
+		return nil
+	}
+	venv := subApp.getPythonLocation(dir)
+	snapshot, err := ioutil.ReadFile(filepath.Join(venv, pythonLockFile))
+	if err != nil {
+		return nil
+	}
+	current, err := runCaptured(dir, venvExecutable(venv), "-m", "pip", "freeze")
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Failed to read python environment: %v", err), subApp)
+		return nil
+	}
+	drift := diffFreeze(parseFreeze(string(snapshot)), parseFreeze(string(current)))
+	subApp.PythonDrift = drift
+	if len(drift) > 0 {
+		logToFile("log", fmt.Sprintf("Python environment drifted from its snapshot: %s", strings.Join(drift, ", ")), subApp, true)
+		broadcastToSocket("pythondrift", PythonDriftEvent{AppId: subApp.Id, Drift: drift})
+	}
+	return drift
+}
+
+// listPythonPackages lists the packages installed for the application
+func (subAppDef *SubApplication) listPythonPackages() ([]PythonPackage, error) {
+	subApp := subAppDef.getCurrent()
+	if subApp == nil {
+		return nil, fmt.Errorf("invalid app")
+	}
+	installLoc, err := getInstallLocation(subApp)
+	if err != nil {
+		return nil, err
+	}
+	python, err := subApp.pythonExecutable(installLoc)
+	if err != nil {
+		return nil, err
+	}
+	output, err := runCaptured(installLoc, python, "-m", "pip", "list", "--format=json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packages: %v", err)
+	}
+	var packages []PythonPackage
+	err = json.Unmarshal(output, &packages)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode package list: %v", err)
+	}
+	defer broadcastToSocket("packages", PythonPackagesEvent{AppId: subApp.Id, Packages: packages})
+	return packages, nil
+}
+
+// parseFreeze parses pip freeze output into package -> requirement line
+func parseFreeze(freeze string) map[string]string {
+	packages := make(map[string]string)
+	for _, line := range strings.Split(freeze, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name := line
+		for _, sep := range []string{"==", " @ "} {
+			if i := strings.Index(line, sep); i > 0 {
+				name = line[:i]
+				break
+			}
+		}
+		packages[strings.ToLower(name)] = line
+	}
+	return packages
+}
+
+// diffFreeze lists packages added (+), removed (-) and changed (~) compared to the snapshot
+func diffFreeze(snapshot map[string]string, current map[string]string) []string {
+	var drift []string
+	for name, line := range current {
+		old, ok := snapshot[name]
+		if !ok {
+			drift = append(drift, "+"+line)
+		} else if old != line {
+			drift = append(drift, fmt.Sprintf("~%s -> %s", old, line))
+		}
+	}
+	for name, line := range snapshot {
+		if _, ok := current[name]; !ok {
+			drift = append(drift, "-"+line)
+		}
+	}
+	sort.Strings(drift)
+	return drift
+}
+
+// runStreamed runs an executable with arguments, sending its output to the application console log.
+// It has a process of its own, pip runs while the application may be live.
+func (subApp *SubApplication) runStreamed(dir string, executable string, args ...string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cmd := exec.CommandContext(ctx, executable, args...)
+	subApp.clearRecentOutput()
+	outputDone, err := subApp.streamOutput(cmd)
+	if err != nil {
+		return err
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Dir = dir
+	logToFile("log", fmt.Sprintf("Running %s %s", executable, strings.Join(args, " ")), subApp)
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	outputDone.Wait()
+	return cmd.Wait()
+}
+
+// runCaptured runs an executable with arguments and returns its standard output
+func runCaptured(dir string, executable string, args ...string) ([]byte, error) {
+	cmd := exec.Command(executable, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true}
+	cmd.Dir = dir
+	return cmd.Output()
+}
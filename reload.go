@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// how often the configuration files are checked for changes
+var reloadInterval = 2 * time.Second
+
+// fields of a subapplication that define it, a change restarts the application
+var subApplicationDefinitionFields = append([]string{"path", "commit", "parameters"}, kitDefinitionFields...)
+
+// ReloadDiff is what changed in a configuration file edited outside the daemon
+type ReloadDiff struct {
+	File            string   `json:"file"`            // config or subapplications
+	Config          []string `json:"config"`          // Changed configuration fields
+	Added           []string `json:"added"`           // Ids of the added applications
+	Removed         []string `json:"removed"`         // Ids of the removed applications
+	Changed         []string `json:"changed"`         // Ids of the applications whose definition changed
+	Skipped         []string `json:"skipped"`         // Ids of the busy applications that were left as they were
+	RestartRequired []string `json:"restartRequired"` // Changed configuration fields that only take effect after a restart
+}
+
+// watchConfigFiles reloads the configuration and the applications when they are changed outside the daemon.
+// Writes of the daemon itself match the memory and reload nothing.
+func watchConfigFiles() {
+	// last version of each entry that was read
+	watched := make(map[string]string)
+	for {
+		time.Sleep(reloadInterval)
+		for _, name := range []string{stateConfig, stateSubApplications} {
+			version, err := getStateStore().Version(name)
+			if err != nil {
+				continue
+			}
+			last, ok := watched[name]
+			if ok && last == version {
+				continue
+			}
+			if !ok {
+				// first look at the entry, it was read at startup
+				watched[name] = version
+				continue
+			}
+			if reloadFile(name) {
+				watched[name] = version
+			}
+		}
+	}
+}
+
+// reloadFile reads a changed file and applies it, it returns false if the file couldn't be
+// read so it is tried again
+func reloadFile(name string) bool {
+	content, err := getStateStore().Read(name)
+	if err != nil {
+		return false
+	}
+	var diff *ReloadDiff
+	if name == stateConfig {
+		diff, err = reloadConfig(content)
+	} else {
+		diff, err = applySubApplications(content, "file", "edited on disk")
+	}
+	if err != nil {
+		// invalid content is kept as seen, the next write of the file is picked up
+		logToMainFile(fmt.Sprintf("Ignoring changes to %s: %v", name, err))
+		return true
+	}
+	if diff != nil {
+		logToMainFile(fmt.Sprintf("Reloaded %s: %d config fields, %d added, %d removed, %d changed applications", name, len(diff.Config), len(diff.Added), len(diff.Removed), len(diff.Changed)))
+		if len(diff.RestartRequired) > 0 {
+			logToMainFile(fmt.Sprintf("Changes to %s take effect after a restart", strings.Join(diff.RestartRequired, ", ")))
+		}
+		broadcastToSocket("reload", diff)
+	}
+	return true
+}
+
+// reloadConfig validates the configuration read from disk and applies the fields that changed.
+// The environment and the command line still override the file.
+func reloadConfig(content []byte) (*ReloadDiff, error) {
+	configMu.Lock()
+	defer configMu.Unlock()
+	config, sources, overrides, err := layerConfig(content)
+	if err != nil {
+		return nil, err
+	}
+	diff := &ReloadDiff{File: stateConfig}
+	errors := []ConfigFieldError{}
+	current := reflect.ValueOf(CurrentConfig)
+	loaded := reflect.ValueOf(config)
+	for i := 0; i < current.NumField(); i++ {
+		if reflect.DeepEqual(current.Field(i).Interface(), loaded.Field(i).Interface()) {
+			continue
+		}
+		name := getConfigFieldName(current.Type().Field(i))
+		diff.Config = append(diff.Config, name)
+		// a field removed from the file falls back to its default
+		if sources[name] != configLayerDefault {
+			if message := validateConfigField(&config, name); message != "" {
+				errors = append(errors, ConfigFieldError{Field: name, Message: message})
+			}
+		}
+	}
+	if len(errors) > 0 {
+		updateErr := &ConfigUpdateError{Errors: errors}
+		broadcastToSocket("configerrors", updateErr)
+		return nil, updateErr
+	}
+	configSources = sources
+	configOverrides = overrides
+	configFileFields, _ = readConfigFileFields(content)
+	if len(diff.Config) == 0 {
+		return nil, nil
+	}
+	CurrentConfig = config
+	diff.RestartRequired = getRestartRequired()
+	recordVersion(historyConfig, content, nil, "file", "edited on disk")
+	broadcastToSocket("config", CurrentConfig)
+	return diff, nil
+}
+
+// applySubApplications applies a list of applications, read from disk or from a saved version:
+// removed ones are stopped, changed ones updated and restarted if running, added ones started
+// if they auto start
+func applySubApplications(content []byte, actor string, reason string) (*ReloadDiff, error) {
+	var entries []json.RawMessage
+	err := json.Unmarshal(content, &entries)
+	if err != nil {
+		return nil, err
+	}
+	loaded := make(map[string]json.RawMessage)
+	order := []string{}
+	for i, entry := range entries {
+		var subApp SubApplication
+		err := json.Unmarshal(entry, &subApp)
+		if err != nil {
+			return nil, fmt.Errorf("application %d: %v", i+1, err)
+		}
+		if subApp.Id == "" {
+			return nil, fmt.Errorf("application %d has no id", i+1)
+		}
+		if _, ok := loaded[subApp.Id]; ok {
+			return nil, fmt.Errorf("application id %s is used twice", subApp.Id)
+		}
+		loaded[subApp.Id] = entry
+		order = append(order, subApp.Id)
+	}
+
+	// busy applications are left as they are, checking the queue takes time so it is done unlocked
+	busy := make(map[string]string)
+	for _, subApp := range subApplications {
+		if entry, ok := loaded[subApp.Id]; !ok || subApp.definitionDiffers(entry) {
+			if isBusy, reason := subApp.isBusy(); isBusy {
+				busy[subApp.Id] = reason
+			}
+		}
+	}
+
+	mu.Lock()
+	diff := &ReloadDiff{File: stateSubApplications}
+	kept := []*SubApplication{}
+	var stopped []*SubApplication
+	for _, subApp := range subApplications {
+		if _, ok := loaded[subApp.Id]; !ok {
+			if reason, isBusy := busy[subApp.Id]; isBusy {
+				logToMainFile(fmt.Sprintf("Not removing application %s, it is busy: %s", subApp.Id, reason))
+				diff.Skipped = append(diff.Skipped, subApp.Id)
+				kept = append(kept, subApp)
+				continue
+			}
+			diff.Removed = append(diff.Removed, subApp.Id)
+			if subApp.Running {
+				stopped = append(stopped, subApp)
+			}
+			continue
+		}
+		kept = append(kept, subApp)
+	}
+	var started []*SubApplication
+	var restarted []*SubApplication
+	for _, id := range order {
+		var existing *SubApplication
+		for _, subApp := range kept {
+			if subApp.Id == id {
+				existing = subApp
+			}
+		}
+		if existing == nil {
+			subApp := &SubApplication{}
+			json.Unmarshal(loaded[id], subApp)
+			subApp.normalizeSetupSteps()
+			kept = append(kept, subApp)
+			diff.Added = append(diff.Added, id)
+			if subApp.AutoStart {
+				started = append(started, subApp)
+			}
+			continue
+		}
+		if reason, isBusy := busy[id]; isBusy {
+			logToMainFile(fmt.Sprintf("Not changing application %s, it is busy: %s", id, reason))
+			diff.Skipped = append(diff.Skipped, id)
+			continue
+		}
+		if existing.applyDefinition(loaded[id]) {
+			diff.Changed = append(diff.Changed, id)
+			if existing.Running {
+				restarted = append(restarted, existing)
+			}
+		}
+	}
+	if len(diff.Added)+len(diff.Removed)+len(diff.Changed) == 0 {
+		mu.Unlock()
+		if len(diff.Skipped) > 0 {
+			return diff, nil
+		}
+		return nil, nil
+	}
+	subApplications = kept
+	saveSubApplicationsAs(actor, reason)
+	mu.Unlock()
+
+	for _, subApp := range stopped {
+		subApp.stop()
+	}
+	for _, subApp := range restarted {
+		go subApp.restart()
+	}
+	for _, subApp := range started {
+		// added applications are installed before they are started
+		go func(subApp *SubApplication) {
+			if !subApp.Installed {
+				subApp.install()
+			}
+			if subApp.Installed {
+				subApp.start()
+			}
+		}(subApp)
+	}
+	return diff, nil
+}
+
+// definitionDiffers checks if entry defines the application differently
+func (subApp *SubApplication) definitionDiffers(entry json.RawMessage) bool {
+	var loaded SubApplication
+	if json.Unmarshal(entry, &loaded) != nil {
+		return false
+	}
+	loaded.normalizeSetupSteps()
+	return !reflect.DeepEqual(getDefinition(subApp, subApplicationDefinitionFields), getDefinition(&loaded, subApplicationDefinitionFields))
+}
+
+// applyDefinition copies the definition fields of entry into the application, keeping its
+// runtime state. It returns whether anything changed.
+func (subApp *SubApplication) applyDefinition(entry json.RawMessage) bool {
+	var loaded SubApplication
+	if json.Unmarshal(entry, &loaded) != nil {
+		return false
+	}
+	loaded.normalizeSetupSteps()
+	current := getDefinition(subApp, subApplicationDefinitionFields)
+	updated := getDefinition(&loaded, subApplicationDefinitionFields)
+	changed := make(map[string]interface{})
+	for field, value := range updated {
+		if !reflect.DeepEqual(current[field], value) {
+			changed[field] = value
+		}
+	}
+	if len(changed) == 0 {
+		return false
+	}
+	encoded, err := json.Marshal(changed)
+	if err != nil {
+		return false
+	}
+	// lists and maps are replaced, not merged into
+	for field := range changed {
+		if value, ok := getSubApplicationField(subApp, field); ok {
+			value.Set(reflect.Zero(value.Type()))
+		}
+	}
+	return json.Unmarshal(encoded, subApp) == nil
+}
+
+// getSubApplicationField returns the field of the application with the given JSON name
+func getSubApplicationField(subApp *SubApplication, name string) (reflect.Value, bool) {
+	value := reflect.ValueOf(subApp).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath == "" && strings.Split(field.Tag.Get("json"), ",")[0] == name {
+			return value.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+var globalMemoryStatusEx = kernel32.NewProc("GlobalMemoryStatusEx")
+
+// results of a requirement check, unknown when the host couldn't be inspected
+const (
+	requirementOk      = "ok"
+	requirementFailed  = "failed"
+	requirementUnknown = "unknown"
+)
+
+// RequirementCheck is the outcome of one requirement against the host
+type RequirementCheck struct {
+	Name     string `json:"name"`     // What was checked, e.g. disk, ram, executable git
+	Required string `json:"required"` // What the kit needs
+	Found    string `json:"found"`    // What the host has
+	Status   string `json:"status"`   // ok, failed or unknown
+}
+
+// RequirementReport is the outcome of the requirement checks before an install
+type RequirementReport struct {
+	Passed bool               `json:"passed"` // No check failed, unknown checks don't fail the report
+	Checks []RequirementCheck `json:"checks"`
+	Time   string             `json:"time"`
+}
+
+// memoryStatusEx is MEMORYSTATUSEX of the windows api
+type memoryStatusEx struct {
+	Length               uint32
+	MemoryLoad           uint32
+	TotalPhys            uint64
+	AvailPhys            uint64
+	TotalPageFile        uint64
+	AvailPageFile        uint64
+	TotalVirtual         uint64
+	AvailVirtual         uint64
+	AvailExtendedVirtual uint64
+}
+
+// gpuInfo is a graphics adapter of the host, VRAMGB is 0 when unknown
+type gpuInfo struct {
+	Name   string
+	VRAMGB int
+}
+
+// getRequirementPolicy returns warn or refuse, what happens when a requirement isn't met
+func getRequirementPolicy() string {
+	if strings.ToLower(CurrentConfig.KitRequirementPolicy) == "warn" {
+		return "warn"
+	}
+	return "refuse"
+}
+
+// checkRequirements evaluates the requirements of the application against the host
+func (subApp *SubApplication) checkRequirements() *RequirementReport {
+	report := &RequirementReport{Passed: true, Checks: []RequirementCheck{}, Time: time.Now().Format(time.RFC3339)}
+	requirements := subApp.Requirements
+	if requirements == nil {
+		return report
+	}
+	add := func(check RequirementCheck) {
+		if check.Status == requirementFailed {
+			report.Passed = false
+		}
+		report.Checks = append(report.Checks, check)
+	}
+
+	if len(requirements.OS) > 0 {
+		add(checkListed("os", requirements.OS, runtime.GOOS))
+	}
+	if len(requirements.Arch) > 0 {
+		add(checkListed("arch", requirements.Arch, runtime.GOARCH))
+	}
+	for _, executable := range requirements.Executables {
+		check := RequirementCheck{Name: "executable " + executable, Required: "on PATH", Status: requirementOk}
+		path, err := exec.LookPath(executable)
+		if err != nil {
+			check.Found = "not found"
+			check.Status = requirementFailed
+		} else {
+			check.Found = path
+		}
+		add(check)
+	}
+
+	if requirements.DiskGB > 0 || requirements.DataDiskGB > 0 {
+		appDrive, appErr := getInstallDrive(subApp)
+		dataDrive, dataErr := getDataDrive()
+		if appErr == nil && dataErr == nil && strings.EqualFold(appDrive, dataDrive) {
+			// both land on the same drive, it must hold both
+			add(checkFreeSpace("disk and data disk", appDrive, nil, requirements.DiskGB+requirements.DataDiskGB))
+		} else {
+			if requirements.DiskGB > 0 {
+				add(checkFreeSpace("disk", appDrive, appErr, requirements.DiskGB))
+			}
+			if requirements.DataDiskGB > 0 {
+				add(checkFreeSpace("data disk", dataDrive, dataErr, requirements.DataDiskGB))
+			}
+		}
+	}
+
+	if requirements.RAMGB > 0 {
+		check := RequirementCheck{Name: "ram", Required: fmt.Sprintf("%d GB", requirements.RAMGB), Found: "unknown", Status: requirementUnknown}
+		if total, err := getTotalMemory(); err == nil {
+			check.Found = fmt.Sprintf("%d GB", toGB(total))
+			check.Status = compareRequirement(toGB(total), requirements.RAMGB)
+		}
+		add(check)
+	}
+
+	if requirements.GPU != "" || requirements.VRAMGB > 0 {
+		gpus, err := detectGPUs()
+		if requirements.GPU != "" {
+			check := RequirementCheck{Name: "gpu", Required: requirements.GPU, Found: "unknown", Status: requirementUnknown}
+			if err == nil {
+				check.Found, check.Status = "none", requirementFailed
+				names := []string{}
+				for _, gpu := range gpus {
+					names = append(names, gpu.Name)
+					if gpuVendor(gpu.Name) == strings.ToLower(requirements.GPU) {
+						check.Status = requirementOk
+					}
+				}
+				if len(names) > 0 {
+					check.Found = strings.Join(names, ", ")
+				}
+			}
+			add(check)
+		}
+		if requirements.VRAMGB > 0 {
+			check := RequirementCheck{Name: "vram", Required: fmt.Sprintf("%d GB", requirements.VRAMGB), Found: "unknown", Status: requirementUnknown}
+			largest := 0
+			for _, gpu := range gpus {
+				if gpu.VRAMGB > largest {
+					largest = gpu.VRAMGB
+				}
+			}
+			if largest > 0 {
+				check.Found = fmt.Sprintf("%d GB", largest)
+				check.Status = compareRequirement(largest, requirements.VRAMGB)
+			}
+			add(check)
+		}
+	}
+	return report
+}
+
+// verifyRequirements checks the requirements before an install. It returns an error when a
+// requirement isn't met and the policy refuses the install, otherwise it only warns.
+func (subApp *SubApplication) verifyRequirements() error {
+	report := subApp.checkRequirements()
+	subApp.RequirementReport = report
+	broadcastToSocket("requirements", map[string]interface{}{"app": subApp.Id, "report": report})
+	problems := []string{}
+	for _, check := range report.Checks {
+		if check.Status != requirementOk {
+			problems = append(problems, fmt.Sprintf("%s: needs %s, found %s", check.Name, check.Required, check.Found))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if !report.Passed && getRequirementPolicy() == "refuse" {
+		return &stepError{step: "requirements", err: fmt.Errorf("requirements not met: %s", strings.Join(problems, "; "))}
+	}
+	logToFile("log", fmt.Sprintf("Installing %s although some requirements are not met or unknown: %s", subApp.Name, strings.Join(problems, "; ")), subApp, true)
+	return nil
+}
+
+// requirementReport checks the requirements of the application without installing it
+func (subAppDef *SubApplication) requirementReport() (*RequirementReport, error) {
+	subApp := subAppDef.getCurrent()
+	if subApp == nil {
+		return nil, fmt.Errorf("invalid app")
+	}
+	report := subApp.checkRequirements()
+	broadcastToSocket("requirements", map[string]interface{}{"app": subApp.Id, "report": report})
+	return report, nil
+}
+
+// checkListed checks that the host value is one of the allowed ones
+func checkListed(name string, allowed []string, value string) RequirementCheck {
+	check := RequirementCheck{Name: name, Required: strings.Join(allowed, " or "), Found: value, Status: requirementFailed}
+	for _, item := range allowed {
+		if strings.EqualFold(item, value) {
+			check.Status = requirementOk
+		}
+	}
+	return check
+}
+
+// checkFreeSpace checks the free space of the drive holding location
+func checkFreeSpace(name string, drive string, err error, neededGB int) RequirementCheck {
+	check := RequirementCheck{Name: name, Required: fmt.Sprintf("%d GB free", neededGB), Found: "unknown", Status: requirementUnknown}
+	if err != nil {
+		return check
+	}
+	_, free, err := GetTotalDiskSpace(drive)
+	if err != nil {
+		return check
+	}
+	check.Found = fmt.Sprintf("%d GB free on %s", toGB(free), drive)
+	check.Status = compareRequirement(toGB(free), neededGB)
+	return check
+}
+
+// getInstallDrive returns the drive the application is installed on, without creating its folder
+func getInstallDrive(subApp *SubApplication) (string, error) {
+	if filepath.IsAbs(subApp.Path) {
+		return getDrive(subApp.Path), nil
+	}
+	if filepath.IsAbs(CurrentConfig.ApplicationFolder) {
+		return getDrive(CurrentConfig.ApplicationFolder), nil
+	}
+	exPath, err := getCurrentPath()
+	if err != nil {
+		return "", err
+	}
+	return getDrive(exPath), nil
+}
+
+// getDataDrive returns the drive of the data folder, without creating it
+func getDataDrive() (string, error) {
+	if filepath.IsAbs(CurrentConfig.DataFolder) {
+		return getDrive(CurrentConfig.DataFolder), nil
+	}
+	exPath, err := getCurrentPath()
+	if err != nil {
+		return "", err
+	}
+	return getDrive(exPath), nil
+}
+
+// getDrive returns the root of the drive holding path
+func getDrive(path string) string {
+	return filepath.VolumeName(path) + "\\"
+}
+
+func compareRequirement(found int, needed int) string {
+	if found >= needed {
+		return requirementOk
+	}
+	return requirementFailed
+}
+
+func toGB(bytes uint64) int {
+	return int(bytes / (1024 * 1024 * 1024))
+}
+
+// getTotalMemory returns the physical memory of the host in bytes
+func getTotalMemory() (uint64, error) {
+	var status memoryStatusEx
+	status.Length = uint32(unsafe.Sizeof(status))
+	r1, _, err := globalMemoryStatusEx.Call(uintptr(unsafe.Pointer(&status)))
+	if r1 == 0 {
+		return 0, err
+	}
+	return status.TotalPhys, nil
+}
+
+// detectGPUs lists the graphics adapters. The memory reported by windows is capped at 4 GB,
+// so it is only known for NVIDIA cards, through nvidia-smi.
+func detectGPUs() ([]gpuInfo, error) {
+	output, err := runCaptured("", "powershell", "-NoProfile", "-Command", "Get-CimInstance Win32_VideoController | Select-Object -ExpandProperty Name")
+	if err != nil {
+		return nil, err
+	}
+	gpus := []gpuInfo{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if name := strings.TrimSpace(line); name != "" {
+			gpus = append(gpus, gpuInfo{Name: name})
+		}
+	}
+	output, err = runCaptured("", "nvidia-smi", "--query-gpu=name,memory.total", "--format=csv,noheader,nounits")
+	if err == nil {
+		for _, line := range strings.Split(string(output), "\n") {
+			parts := strings.Split(line, ",")
+			if len(parts) != 2 {
+				continue
+			}
+			megabytes, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+			if err != nil {
+				continue
+			}
+			for i := range gpus {
+				if gpus[i].VRAMGB == 0 && strings.Contains(gpus[i].Name, strings.TrimSpace(parts[0])) {
+					gpus[i].VRAMGB = megabytes / 1024
+					break
+				}
+			}
+		}
+	}
+	return gpus, nil
+}
+
+// gpuVendor returns the vendor of a graphics adapter from its name
+func gpuVendor(name string) string {
+	name = strings.ToLower(name)
+	switch {
+	case strings.Contains(name, "nvidia"), strings.Contains(name, "geforce"), strings.Contains(name, "quadro"):
+		return "nvidia"
+	case strings.Contains(name, "amd"), strings.Contains(name, "radeon"):
+		return "amd"
+	case strings.Contains(name, "intel"):
+		return "intel"
+	}
+	return ""
+}
@@ -6,6 +6,8 @@ func scheduler() {
 	go checkSubapplications()
 	go checkDiskspace()
 	go checkSubApplicationUpdates()
+	go applySubApplicationUpdates()
+	go watchConfigFiles()
 }
 
 func checkSubApplicationUpdates() {
@@ -20,6 +22,14 @@ func checkSubApplicationUpdates() {
 
 }
 
+// applySubApplicationUpdates regularly applies pending updates, so maintenance windows are not missed
+func applySubApplicationUpdates() {
+	for {
+		time.Sleep(5 * time.Minute)
+		applyPendingUpdates()
+	}
+}
+
 //run operations at regular interval
 func checkSubapplications() {
 	for {
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secrets are kept encrypted in their own file, never in subapplications.json or config.json
+var secretsFile = "secrets.json"
+
+// default key file, next to the executable, created on first use when MRG_SECRETS_KEY isn't set
+var secretsKeyFile = "secrets.key"
+
+// environment variable holding the base64 encoded 32 byte key of the secrets file
+var secretsKeyEnv = configEnvPrefix + "SECRETS_KEY"
+
+// secrets shorter than this aren't redacted, they would mask unrelated text
+var secretRedactMinLength = 4
+
+var secretNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+var secretPlaceholderPattern = regexp.MustCompile(`\$\{secret:([A-Za-z0-9_.-]+)\}`)
+
+// Secret is a named value, e.g. a Hugging Face token, referenced as ${secret:NAME}
+type Secret struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Updated string `json:"updated"` // When the value was last set
+}
+
+// SecretInfo is what the API shows of a secret, the value is left out
+type SecretInfo struct {
+	Name    string `json:"name"`
+	Updated string `json:"updated"`
+}
+
+// encryptedSecrets is the content of the secrets file
+type encryptedSecrets struct {
+	Nonce string `json:"nonce"` // Base64 AES-GCM nonce
+	Data  string `json:"data"`  // Base64 AES-GCM sealed JSON list of secrets
+}
+
+var secrets = make(map[string]*Secret)
+var redactedValues = make(map[string]string) // Masked form of every secret value seen since start
+var secretsRedactor *strings.Replacer
+var secretsMu sync.RWMutex
+var secretsLoadErr error // Why the secrets file couldn't be read, nothing is written over it until it can
+
+// getSecretsKey returns the key from MRG_SECRETS_KEY, or from the key file configured in
+// secretsKeyFile, generating the default key file if there is none
+func getSecretsKey(create bool) ([]byte, error) {
+	encoded, fromEnv := os.LookupEnv(secretsKeyEnv)
+	path := CurrentConfig.SecretsKeyFile
+	if !fromEnv {
+		if path == "" || !filepath.IsAbs(path) {
+			exPath, err := getCurrentPath()
+			if err != nil {
+				return nil, err
+			}
+			if path == "" {
+				path = secretsKeyFile
+			}
+			path = filepath.Join(exPath, path)
+		}
+		content, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) && create && CurrentConfig.SecretsKeyFile == "" {
+			key := make([]byte, 32)
+			if _, err := io.ReadFull(rand.Reader, key); err != nil {
+				return nil, err
+			}
+			err = writeFileAtomic(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create the secrets key file %s: %v", path, err)
+			}
+			logToMainFile(fmt.Sprintf("Created the secrets key file %s, keep a copy of it to restore the secrets", path))
+			return key, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the secrets key file %s: %v", path, err)
+		}
+		encoded = string(content)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil || len(key) != 32 {
+		if fromEnv {
+			return nil, fmt.Errorf("%s must be a base64 encoded 32 byte key", secretsKeyEnv)
+		}
+		return nil, fmt.Errorf("the secrets key file %s must hold a base64 encoded 32 byte key", path)
+	}
+	return key, nil
+}
+
+// readSecrets loads and decrypts the secrets file, a missing file means no secrets
+func readSecrets() error {
+	content, err := getStateStore().Read(stateSecrets)
+	if os.IsNotExist(err) {
+		setSecretsLoadErr(nil)
+		return nil
+	}
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error opening secrets file: %v", err))
+		setSecretsLoadErr(err)
+		return err
+	}
+	var stored []*Secret
+	err = decryptSecrets(content, &stored)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error decrypting secrets file: %v", err))
+		setSecretsLoadErr(err)
+		return err
+	}
+	secretsMu.Lock()
+	secretsLoadErr = nil
+	secrets = make(map[string]*Secret)
+	for _, secret := range stored {
+		secrets[secret.Name] = secret
+	}
+	updateSecretsRedactor()
+	secretsMu.Unlock()
+	return nil
+}
+
+func setSecretsLoadErr(err error) {
+	secretsMu.Lock()
+	secretsLoadErr = err
+	secretsMu.Unlock()
+}
+
+// checkSecretsLoaded refuses changes while the secrets file couldn't be read, saving would replace
+// the secrets it holds, with a new key if the key is missing. The file is read again first, the
+// key may have been restored since.
+func checkSecretsLoaded() error {
+	secretsMu.RLock()
+	err := secretsLoadErr
+	secretsMu.RUnlock()
+	if err == nil {
+		return nil
+	}
+	if err := readSecrets(); err != nil {
+		return fmt.Errorf("the secrets file can't be read, not overwriting it: %v", err)
+	}
+	return nil
+}
+
+// writeSecrets encrypts and saves the secrets, the caller holds secretsMu
+func writeSecrets(gcm cipher.AEAD) error {
+	stored := []*Secret{}
+	for _, secret := range secrets {
+		stored = append(stored, secret)
+	}
+	sort.Slice(stored, func(i, j int) bool { return stored[i].Name < stored[j].Name })
+	content, err := encryptSecrets(gcm, stored)
+	if err != nil {
+		return err
+	}
+	return getStateStore().Write(stateSecrets, content)
+}
+
+func getSecretsCipher(create bool) (cipher.AEAD, error) {
+	key, err := getSecretsKey(create)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func encryptSecrets(gcm cipher.AEAD, value interface{}) ([]byte, error) {
+	plain, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, nonce, plain, []byte(secretsFile))
+	return json.MarshalIndent(encryptedSecrets{
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+		Data:  base64.StdEncoding.EncodeToString(sealed),
+	}, "", "    ")
+}
+
+func decryptSecrets(content []byte, value interface{}) error {
+	var stored encryptedSecrets
+	err := json.Unmarshal(content, &stored)
+	if err != nil {
+		return err
+	}
+	gcm, err := getSecretsCipher(false)
+	if err != nil {
+		return err
+	}
+	nonce, err := base64.StdEncoding.DecodeString(stored.Nonce)
+	if err != nil || len(nonce) != gcm.NonceSize() {
+		return fmt.Errorf("invalid nonce")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(stored.Data)
+	if err != nil {
+		return err
+	}
+	plain, err := gcm.Open(nil, nonce, sealed, []byte(secretsFile))
+	if err != nil {
+		return fmt.Errorf("wrong key or damaged file")
+	}
+	return json.Unmarshal(plain, value)
+}
+
+// listSecrets returns the names of the secrets, sorted
+func listSecrets() []SecretInfo {
+	secretsMu.RLock()
+	infos := []SecretInfo{}
+	for _, secret := range secrets {
+		infos = append(infos, SecretInfo{Name: secret.Name, Updated: secret.Updated})
+	}
+	secretsMu.RUnlock()
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	defer broadcastToSocket("secrets", infos)
+	return infos
+}
+
+// setSecret adds or replaces the secret with the same name
+func setSecret(secret Secret) ([]SecretInfo, error) {
+	if !secretNamePattern.MatchString(secret.Name) {
+		return nil, fmt.Errorf("name must only contain letters, digits, '.', '_' and '-'")
+	}
+	if secret.Value == "" {
+		return nil, fmt.Errorf("value is required")
+	}
+	secret.Updated = time.Now().Format(time.RFC3339)
+	if err := checkSecretsLoaded(); err != nil {
+		logToMainFile(fmt.Sprintf("Error saving secrets file: %v", err))
+		return nil, err
+	}
+	// the key is read, or created on first use, before locking as creating it is logged
+	gcm, err := getSecretsCipher(true)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error saving secrets file: %v", err))
+		return nil, err
+	}
+	secretsMu.Lock()
+	previous := secrets[secret.Name]
+	secrets[secret.Name] = &secret
+	err = writeSecrets(gcm)
+	if err != nil {
+		if previous != nil {
+			secrets[secret.Name] = previous
+		} else {
+			delete(secrets, secret.Name)
+		}
+	}
+	updateSecretsRedactor()
+	secretsMu.Unlock()
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error saving secrets file: %v", err))
+		return nil, err
+	}
+	logToMainFile(fmt.Sprintf("Set secret %s", secret.Name))
+	return listSecrets(), nil
+}
+
+// deleteSecret removes the secret with the given name
+func deleteSecret(name string) ([]SecretInfo, error) {
+	if err := checkSecretsLoaded(); err != nil {
+		logToMainFile(fmt.Sprintf("Error saving secrets file: %v", err))
+		return nil, err
+	}
+	gcm, err := getSecretsCipher(false)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error saving secrets file: %v", err))
+		return nil, err
+	}
+	secretsMu.Lock()
+	previous, ok := secrets[name]
+	if !ok {
+		secretsMu.Unlock()
+		return nil, fmt.Errorf("secret %s not found", name)
+	}
+	delete(secrets, name)
+	err = writeSecrets(gcm)
+	if err != nil {
+		secrets[name] = previous
+	}
+	secretsMu.Unlock()
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Error saving secrets file: %v", err))
+		return nil, err
+	}
+	logToMainFile(fmt.Sprintf("Deleted secret %s", name))
+	return listSecrets(), nil
+}
+
+// expandSecrets replaces ${secret:NAME} in value, unknown secrets are left as they are
+func expandSecrets(value string) string {
+	if !strings.Contains(value, "${secret:") {
+		return value
+	}
+	missing := []string{}
+	secretsMu.RLock()
+	expanded := secretPlaceholderPattern.ReplaceAllStringFunc(value, func(placeholder string) string {
+		name := secretPlaceholderPattern.FindStringSubmatch(placeholder)[1]
+		if secret, ok := secrets[name]; ok {
+			return secret.Value
+		}
+		missing = append(missing, name)
+		return placeholder
+	})
+	secretsMu.RUnlock()
+	for _, name := range missing {
+		logToMainFile(fmt.Sprintf("Secret %s not found", name))
+	}
+	return expanded
+}
+
+// updateSecretsRedactor rebuilds the replacer that masks secret values, the caller holds secretsMu.
+// Values of deleted secrets stay masked, they may still show up in the output of running applications.
+func updateSecretsRedactor() {
+	for _, secret := range secrets {
+		if len(secret.Value) >= secretRedactMinLength {
+			redactedValues[secret.Value] = "${secret:" + secret.Name + "}"
+		}
+	}
+	if len(redactedValues) == 0 {
+		return
+	}
+	values := make([]string, 0, len(redactedValues))
+	for value := range redactedValues {
+		values = append(values, value)
+	}
+	// longer values first, so a secret containing another one is masked as a whole
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	pairs := []string{}
+	for _, value := range values {
+		pairs = append(pairs, value, redactedValues[value])
+	}
+	secretsRedactor = strings.NewReplacer(pairs...)
+}
+
+// redactSecrets masks the secret values in message
+func redactSecrets(message string) string {
+	secretsMu.RLock()
+	redactor := secretsRedactor
+	secretsMu.RUnlock()
+	if redactor == nil {
+		return message
+	}
+	return redactor.Replace(message)
+}
+
+// redactSecretsData masks the secret values in the strings of data sent to the websocket clients
+func redactSecretsData(data interface{}) interface{} {
+	secretsMu.RLock()
+	redactor := secretsRedactor
+	secretsMu.RUnlock()
+	if redactor == nil {
+		return data
+	}
+	encoded, err := json.Marshal(data)
+	// without escapes JSON strings are plain text, so nothing to mask means no secret
+	if err != nil || (!strings.Contains(string(encoded), `\`) && redactor.Replace(string(encoded)) == string(encoded)) {
+		return data
+	}
+	decoder := json.NewDecoder(strings.NewReader(string(encoded)))
+	decoder.UseNumber()
+	var value interface{}
+	if decoder.Decode(&value) != nil {
+		return data
+	}
+	return redactValue(value, redactor)
+}
+
+// redactValue masks the secret values in the strings of a decoded JSON value
+func redactValue(value interface{}, redactor *strings.Replacer) interface{} {
+	switch typed := value.(type) {
+	case string:
+		return redactor.Replace(typed)
+	case []interface{}:
+		for i, item := range typed {
+			typed[i] = redactValue(item, redactor)
+		}
+	case map[string]interface{}:
+		redacted := make(map[string]interface{}, len(typed))
+		for key, item := range typed {
+			redacted[redactor.Replace(key)] = redactValue(item, redactor)
+		}
+		return redacted
+	}
+	return value
+}
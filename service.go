@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 )
@@ -10,26 +11,50 @@ type myService struct {
 	done chan struct{}
 }
 
-func run() {
+// run starts the daemon, it fails if the API can't be served
+func run() error {
 	var err error = nil
+	_, err = loadConfig()
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Could not load the configuration, starting with the defaults: %v", err))
+		loadDefaultConfig()
+	}
 	subApplications, err = readSubApplications()
 	if err != nil {
 		logToMainFile("Could not read configuration file for applications.")
 	}
+	readCredentials()
+	readSecrets()
+	moved := false
+	for _, subApp := range subApplications {
+		if subApp.moveURLCredentials() {
+			moved = true
+		}
+	}
+	if moved {
+		saveSubApplications()
+	}
 
-	go readConfigFile()
-	go startServer()
+	err = startServer()
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Could not start the API: %v", err))
+		return err
+	}
 
 	scheduler()
 	//detectGPU()
 	detectGPU_Windows()
 	autoStart()
+	return nil
 }
 
 func runInteractive() {
 	log.Print("Running in interactive mode")
 	service := newMyService()
-	run()
+	err := run()
+	if err != nil {
+		log.Fatalf("failed to start: %v", err)
+	}
 	baseLoop(service.quit, service.done)
 }
 
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// SetupStep is a single named step of the setup pipeline of a subapplication
+type SetupStep struct {
+	Name            string            `json:"name"`            // Name of the step, used to track its status
+	Command         string            `json:"command"`         // Command to run, $dir and ${python} are replaced
+	WorkingDir      string            `json:"workingDir"`      // Working directory, relative to the install location
+	Env             map[string]string `json:"env"`             // Extra environment variables for the command
+	Timeout         int               `json:"timeout"`         // Timeout in minutes, 0 means no timeout
+	Retries         int               `json:"retries"`         // How many times the step is retried after a failure
+	SkipIfUnchanged []string          `json:"skipIfUnchanged"` // Files whose hash, if unchanged since the last successful run, skip the step
+	SkipIfExists    string            `json:"skipIfExists"`    // Path, relative to the install location, that skips the step if it exists
+	builtin         bool              // Step implemented by the daemon instead of a command
+}
+
+// SetupStepStatus tracks the outcome of a setup step
+type SetupStepStatus struct {
+	Status   string `json:"status"`   // pending, running, succeeded, failed or skipped
+	Attempts int    `json:"attempts"` // Attempts made during the last run
+	Hash     string `json:"hash"`     // Hash of the SkipIfUnchanged files at the last successful run
+	Started  string `json:"started"`  // When the step was last started
+	Finished string `json:"finished"` // When the step last finished
+	Error    string `json:"error"`    // Error of the last failed attempt
+}
+
+// SetupState holds the status of each setup step, by step name
+type SetupState map[string]*SetupStepStatus
+
+// stepError is an error that remembers which step of an operation failed
+type stepError struct {
+	step string
+	err  error
+}
+
+func (e *stepError) Error() string {
+	return e.err.Error()
+}
+
+// failedStep returns the step that produced the error, if known
+func failedStep(err error) string {
+	if se, ok := err.(*stepError); ok {
+		return se.step
+	}
+	return ""
+}
+
+// getSetupSteps returns the setup steps, converting the legacy setup command if needed
+func (subApp *SubApplication) getSetupSteps() []SetupStep {
+	if len(subApp.SetupSteps) > 0 {
+		return subApp.SetupSteps
+	}
+	if subApp.SetupCommand != "" {
+		return []SetupStep{{Name: "setup", Command: subApp.SetupCommand}}
+	}
+	return nil
+}
+
+// normalizeSetupSteps replaces the legacy setup command with the equivalent setup step.
+// The name of the managed python step is reserved, a step using it is renamed like an unnamed one.
+// Steps are tracked by name, so a name used by an earlier step gets the number of the step appended.
+func (subApp *SubApplication) normalizeSetupSteps() {
+	subApp.SetupSteps = subApp.getSetupSteps()
+	subApp.SetupCommand = ""
+	used := map[string]bool{pythonStepName: true}
+	for i := range subApp.SetupSteps {
+		name := subApp.SetupSteps[i].Name
+		if name == "" || name == pythonStepName {
+			name = fmt.Sprintf("step%d", i+1)
+		}
+		for base, n := name, i+1; used[name]; n++ {
+			name = fmt.Sprintf("%s-%d", base, n)
+		}
+		used[name] = true
+		subApp.SetupSteps[i].Name = name
+	}
+}
+
+// hasFailedSetup checks if the last operation failed in one of the setup steps
+func (subApp *SubApplication) hasFailedSetup(operation string) bool {
+	if subApp.LastError == nil || subApp.LastError.Operation != operation {
+		return false
+	}
+	if subApp.Python != nil && subApp.LastError.Step == pythonStepName {
+		return true
+	}
+	for _, step := range subApp.getSetupSteps() {
+		if step.Name == subApp.LastError.Step {
+			return true
+		}
+	}
+	return false
+}
+
+// runSetup runs the setup steps in order inside dir.
+// When resuming, steps that already succeeded in the previous run are not run again.
+func (subApp *SubApplication) runSetup(dir string, resume bool) error {
+	subApp.normalizeSetupSteps()
+	steps := subApp.SetupSteps
+	if subApp.Python != nil {
+		steps = append([]SetupStep{subApp.getPythonStep()}, steps...)
+	}
+	states := make(SetupState)
+	for _, step := range steps {
+		state := subApp.SetupState[step.Name]
+		if state == nil {
+			state = &SetupStepStatus{Status: "pending"}
+		} else if !resume {
+			state.Status = "pending"
+			state.Error = ""
+			state.Attempts = 0
+		}
+		states[step.Name] = state
+	}
+	subApp.SetupState = states
+
+	for _, step := range steps {
+		state := subApp.SetupState[step.Name]
+		if resume && (state.Status == "succeeded" || state.Status == "skipped") && !subApp.isBuiltinMissing(dir, step) {
+			logToFile("log", fmt.Sprintf("Setup step %s already done, resuming after it", step.Name), subApp)
+			continue
+		}
+		hash := hashFiles(dir, step.SkipIfUnchanged)
+		if skip, reason := step.shouldSkip(dir, state, hash); skip && !subApp.isBuiltinMissing(dir, step) {
+			logToFile("log", fmt.Sprintf("Skipping setup step %s: %s", step.Name, reason), subApp)
+			state.Status = "skipped"
+			continue
+		}
+
+		state.Status = "running"
+		state.Started = time.Now().Format(time.RFC3339)
+		state.Attempts = 0
+		broadcastToSocket("setupstate", subApp.getSetupStateEvent())
+		var err error
+		for attempt := 0; attempt <= step.Retries; attempt++ {
+			if attempt > 0 {
+				logToFile("log", fmt.Sprintf("Retrying setup step %s (%d/%d)", step.Name, attempt, step.Retries), subApp)
+			}
+			state.Attempts++
+			if step.builtin {
+				err = subApp.setupPythonEnvironment(dir)
+			} else {
+				err = subApp.runSetupStep(dir, step)
+			}
+			if err == nil {
+				break
+			}
+		}
+		state.Finished = time.Now().Format(time.RFC3339)
+		if err != nil {
+			state.Status = "failed"
+			state.Error = err.Error()
+			saveSubApplications()
+			broadcastToSocket("setupstate", subApp.getSetupStateEvent())
+			return &stepError{step: step.Name, err: fmt.Errorf("setup step %s failed: %v", step.Name, err)}
+		}
+		state.Status = "succeeded"
+		state.Error = ""
+		state.Hash = hash
+		saveSubApplications()
+		broadcastToSocket("setupstate", subApp.getSetupStateEvent())
+	}
+	return nil
+}
+
+// shouldSkip evaluates the skip conditions of the step
+func (step *SetupStep) shouldSkip(dir string, state *SetupStepStatus, hash string) (bool, string) {
+	if step.SkipIfExists != "" {
+		if _, err := os.Stat(filepath.Join(dir, step.SkipIfExists)); err == nil {
+			return true, fmt.Sprintf("%s exists", step.SkipIfExists)
+		}
+	}
+	if hash != "" && state.Hash == hash {
+		return true, fmt.Sprintf("%s unchanged", strings.Join(step.SkipIfUnchanged, ", "))
+	}
+	return false, ""
+}
+
+// isBuiltinMissing checks if what a builtin step creates is missing, in which case it can't be skipped
+func (subApp *SubApplication) isBuiltinMissing(dir string, step SetupStep) bool {
+	if !step.builtin || subApp.Python == nil {
+		return false
+	}
+	_, err := os.Stat(venvExecutable(subApp.getPythonLocation(dir)))
+	return err != nil
+}
+
+// runSetupStep runs the command of a single setup step
+func (subApp *SubApplication) runSetupStep(dir string, step SetupStep) error {
+	command, err := subApp.expandPlaceholders(step.Command, dir)
+	if err != nil {
+		return err
+	}
+	commandParams := strings.Split(command, " ")
+	command = commandParams[0]
+
+	joinedRest := strings.Join(commandParams[1:], " ")
+
+	// placeholders are expanded before the command exists, so a failure leaves nothing behind
+	workingDir := dir
+	if step.WorkingDir != "" {
+		workingDir, err = subApp.expandPlaceholders(step.WorkingDir, dir)
+		if err != nil {
+			return err
+		}
+		if !filepath.IsAbs(workingDir) {
+			workingDir = filepath.Join(dir, workingDir)
+		}
+	}
+	var env []string
+	if len(step.Env) > 0 {
+		env = os.Environ()
+		for key, value := range step.Env {
+			expanded, err := subApp.expandPlaceholders(value, dir)
+			if err != nil {
+				return err
+			}
+			env = append(env, fmt.Sprintf("%s=%s", key, expanded))
+		}
+	}
+
+	// the step has a process of its own, the application may be running while it is set up
+	ctx, cancel := context.WithCancel(context.Background())
+	cmd := exec.CommandContext(ctx, command)
+	subApp.clearRecentOutput()
+	outputDone, err := subApp.streamOutput(cmd)
+	if err != nil {
+		cancel()
+		logToFile("log", fmt.Sprintf("Error creating command for subapplication %s: %v", subApp.Name, err), subApp)
+		return err
+	}
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true, CmdLine: joinedRest}
+	cmd.Dir = workingDir
+	cmd.Env = env
+	logToFile("log", fmt.Sprintf("Running setup step %s for subapplication %s: %s", step.Name, subApp.Name, command), subApp)
+	logToFile("log", fmt.Sprintf("	with params: %s", joinedRest), subApp)
+
+	err = cmd.Start()
+	if err != nil {
+		cancel()
+		logToMainFile(fmt.Sprintf("Failed to run setup step %s for subapplication %s: %v", step.Name, subApp.Name, err))
+		return err
+	}
+	var timedOut int32
+	if step.Timeout > 0 {
+		timer := time.AfterFunc(time.Duration(step.Timeout)*time.Minute, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			cancel()
+		})
+		defer timer.Stop()
+	}
+	// the output is read to the end first, so the error report has its last lines
+	outputDone.Wait()
+	err = cmd.Wait()
+	cancel()
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return fmt.Errorf("timed out after %d minutes", step.Timeout)
+	}
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Setup step %s for subapplication %s failed: %v", step.Name, subApp.Name, err), subApp, true)
+		return err
+	}
+	return nil
+}
+
+// hashFiles hashes the content of the given files, relative to dir
+func hashFiles(dir string, files []string) string {
+	if len(files) == 0 {
+		return ""
+	}
+	hash := sha256.New()
+	for _, file := range files {
+		hash.Write([]byte(file))
+		content, err := ioutil.ReadFile(filepath.Join(dir, file))
+		if err != nil {
+			hash.Write([]byte("missing"))
+			continue
+		}
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// SetupStateEvent is broadcast when a setup step changes status
+type SetupStateEvent struct {
+	AppId string     `json:"appId"`
+	Steps SetupState `json:"steps"`
+}
+
+func (subApp *SubApplication) getSetupStateEvent() SetupStateEvent {
+	return SetupStateEvent{AppId: subApp.Id, Steps: subApp.SetupState}
+}
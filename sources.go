@@ -4,9 +4,8 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"gopkg.in/src-d/go-git.v4"
@@ -19,39 +18,26 @@ type GitHubContent struct {
 
 // constructGitHubAPIURL constructs the URL for the GitHub API
 func constructGitHubAPIURL(repo string, path string) string {
-	parts := strings.Split(repo, "/")
-
-	owner, repoName := parts[0], parts[1]
-	if len(parts) == 5 {
-		owner, repoName = parts[3], parts[4]
-	}
-	if len(parts) != 2 && len(parts) != 5 {
+	parts := strings.Split(normalizeRemote(repo), "/")
+	if len(parts) != 3 || parts[0] != "github.com" {
 		logToMainFile("Invalid repository format. Use 'owner/repo' or github link")
 		return ""
 	}
+	owner, repoName := parts[1], parts[2]
 	return fmt.Sprintf("https://api.github.com/repos/%s/%s/contents/%s", owner, repoName, path)
 }
 
-// readGitHubFile reads a file from a GitHub repository
-func readGitHubFile(repo string, path string) (string, error) {
+// readGitHubFile reads a file from a GitHub repository.
+// It returns errNotModified if the file still matches the validators.
+func readGitHubFile(repo string, path string, validators *kitValidators) (string, error) {
 	url := constructGitHubAPIURL(repo, path)
 	if url == "" {
 		return "", fmt.Errorf("invalid repository format")
 	}
 
-	resp, err := http.Get(url)
+	body, err := readHTTPFile(url, repo, "", validators)
 	if err != nil {
-		return "", fmt.Errorf("error making request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("error: HTTP status %d", resp.StatusCode)
-	}
-
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("error reading response body: %v", err)
+		return "", err
 	}
 
 	var content GitHubContent
@@ -68,90 +54,186 @@ func readGitHubFile(repo string, path string) (string, error) {
 	return string(decoded), nil
 }
 
-// getAllKits gets all kits from all kit repositories
-func getAllKits() []SubApplication {
-
-	var kits []SubApplication = getKitList(mainAppKitRepository)
-	for _, repo := range CurrentConfig.AppKitRepositories {
-		other := getKitList(repo)
-		for _, k := range other {
-			//probably should add more validations here
-			found := false
-			for _, kit := range kits {
-				if kit.Id == k.Id {
-					found = true
-					break
-				}
-			}
-			if !found {
-				kits = append(kits, k)
-			}
-
-		}
-	}
-	broadcastToSocket("kits", kits)
-	return kits
-}
-
-// getKitList gets the list of kits from a repository
-func getKitList(repoUrl string) []SubApplication {
-	content, err := readGitHubFile(repoUrl, "list.json")
-	if err != nil {
-		logToMainFile(fmt.Sprintf("Failed to get kits list: %v", err))
-		return nil
-	}
-
-	var kits []SubApplication
-	err = json.Unmarshal([]byte(content), &kits)
-	if err != nil {
-		logToMainFile(fmt.Sprintf("Failed to unmarshal kits list: %v", err))
-		return nil
-	}
-	return kits
-}
-
 // install a subapplication
+// the repository is cloned and prepared in a staging directory and only moved
+// into the install location once everything succeeded
 func (subAppDef *SubApplication) install() bool {
 	subApp := subAppDef.getCurrent()
 	if subApp == nil {
 		return false
 	}
-	subApp.updateStatus("Installing")
-	logToMainFile(fmt.Sprintf("Installing subapplication: %s", subApp.Name))
+	if err := subApp.checkKitAllowed(); err != nil {
+		subApp.setLastError("install", err, "")
+		return false
+	}
 	installLoc, err := getInstallLocation(subApp)
 	if err != nil {
 		logToFile("log", fmt.Sprintf("Failed to get install location for subapplication %s: %v", subApp.Name, err), nil)
 		return false
 	}
-	repo, err := git.PlainClone(installLoc, false, &git.CloneOptions{
-		URL:           subApp.RepoURL,
-		ReferenceName: plumbing.NewBranchReferenceName(subApp.Branch),
-		Progress:      os.Stdout,
-	})
-	if err != nil {
-		logToMainFile(fmt.Sprintf("Failed to install subapplication %s: %v", subApp.Name, err))
+	if _, err := git.PlainOpen(installLoc); err == nil && subApp.Installed {
+		logToMainFile(fmt.Sprintf("Subapplication %s is already installed in %s", subApp.Name, installLoc))
+		subApp.updateStatus("Installed")
+		return false
+	}
+	if err := subApp.verifyRequirements(); err != nil {
+		subApp.setLastError("install", err, "")
 		return false
 	}
-	// init submodules
-	err = initSubModules(repo, subApp)
+	subApp.updateStatus("Installing")
+	logToMainFile(fmt.Sprintf("Installing subapplication: %s", subApp.Name))
+	if !isEmptyDir(installLoc) {
+		// leftovers of an install that never completed
+		logToMainFile(fmt.Sprintf("Removing incomplete install of subapplication %s from %s", subApp.Name, installLoc))
+		err = os.RemoveAll(installLoc)
+		if err != nil {
+			subApp.setLastError("install", fmt.Errorf("failed to remove incomplete install %s: %v", installLoc, err), "")
+			return false
+		}
+	}
+
+	// the python environment is built in the install location, environments can't be moved
+	keep := []string{}
+	if subApp.Python != nil && !filepath.IsAbs(subApp.Python.getPath("")) {
+		subApp.pythonHome = installLoc
+		defer func() { subApp.pythonHome = "" }()
+		keep = append(keep, subApp.Python.getPath(""))
+	}
+	stagingLoc := getStagingLocation(installLoc)
+	resume := subApp.canResumeInstall(stagingLoc)
+	if resume {
+		logToMainFile(fmt.Sprintf("Resuming install of subapplication %s from step %s", subApp.Name, subApp.LastError.Step))
+	} else {
+		subApp.SetupState = nil
+		stagingLoc, err = prepareStagingLocation(installLoc)
+		if err != nil {
+			subApp.setLastError("install", err, "")
+			return false
+		}
+	}
+	err = subApp.installInto(stagingLoc, resume)
 	if err != nil {
+		subApp.setLastError("install", err, stagingLoc)
 		return false
 	}
-	//run setup comand
-	err = subApp.runSetupCommand()
+	err = swapIntoPlace(stagingLoc, installLoc, keep...)
 	if err != nil {
+		subApp.setLastError("install", err, stagingLoc)
 		return false
 	}
 
+	subApp.restoreCustomNodes(installLoc)
+
 	logToMainFile(fmt.Sprintf("Installed subapplication %s", subApp.Name))
+	subApp.LastError = nil
 	subApp.Installed = true
 	subApp.FirstRun = true
+	subApp.updateStatus("Installed")
 	saveSubApplications()
-
-	subApp.checkSymLinks()
 	return true
 }
 
+// installInto clones the repository into dir and runs submodules, setup and symlinks there.
+// When resuming, the clone in dir is kept and the setup continues from the failed step.
+func (subApp *SubApplication) installInto(dir string, resume bool) error {
+	if !resume {
+		repo, err := cloneRepository(dir, subApp.RepoURL, subApp.Branch)
+		if err != nil {
+			return &stepError{step: "clone", err: fmt.Errorf("failed to clone %s: %v", subApp.RepoURL, err)}
+		}
+		err = subApp.checkoutPinnedCommit(repo)
+		if err != nil {
+			return &stepError{step: "clone", err: fmt.Errorf("failed to check out commit %s: %v", subApp.Commit, err)}
+		}
+		// init submodules
+		err = initSubModules(repo, subApp)
+		if err != nil {
+			return &stepError{step: "submodules", err: fmt.Errorf("failed to initialize submodules: %v", err)}
+		}
+	}
+	//run setup steps
+	err := subApp.runSetup(dir, resume)
+	if err != nil {
+		return err
+	}
+	subApp.checkSymLinks(dir)
+	return nil
+}
+
+// canResumeInstall checks if a previous install failed during setup and left a usable clone in stagingLoc
+func (subApp *SubApplication) canResumeInstall(stagingLoc string) bool {
+	if !subApp.hasFailedSetup("install") || subApp.LastError.StagingDir != stagingLoc {
+		return false
+	}
+	_, err := git.PlainOpen(stagingLoc)
+	return err == nil
+}
+
+// cloneRepository clones url into dir, checking out branch or the default branch if empty
+func cloneRepository(dir string, url string, branch string) (*git.Repository, error) {
+	if useMirrors() {
+		repo, err := cloneFromMirror(dir, url, branch)
+		if err == nil {
+			return repo, nil
+		}
+		logToMainFile(fmt.Sprintf("Failed to clone %s from the mirror cache, cloning directly: %v", url, err))
+		os.RemoveAll(dir)
+	}
+	options := &git.CloneOptions{
+		URL:      url,
+		Auth:     authForRemote(url),
+		Progress: os.Stdout,
+	}
+	if branch != "" {
+		options.ReferenceName = plumbing.NewBranchReferenceName(branch)
+	}
+	return git.PlainClone(dir, false, options)
+}
+
+// fetchOrigin fetches the origin remote of a repository, returning git.NoErrAlreadyUpToDate if nothing changed
+func fetchOrigin(repo *git.Repository) error {
+	if useMirrors() {
+		err := fetchFromMirror(repo)
+		if err == nil || err == git.NoErrAlreadyUpToDate {
+			return err
+		}
+		logToMainFile(fmt.Sprintf("Failed to fetch %s through the mirror cache, fetching directly: %v", originURL(repo), err))
+	}
+	return repo.Fetch(&git.FetchOptions{
+		RemoteName: "origin",
+		Auth:       authForRemote(originURL(repo)),
+		Progress:   os.Stdout,
+		Tags:       git.AllTags,
+	})
+}
+
+// pullBranch pulls branch from origin into the worktree, including submodules
+func pullBranch(repo *git.Repository, w *git.Worktree, branch string) error {
+	if useMirrors() {
+		err := fetchFromMirror(repo)
+		if err == nil || err == git.NoErrAlreadyUpToDate {
+			return fastForward(repo, w, branch)
+		}
+		logToMainFile(fmt.Sprintf("Failed to fetch %s through the mirror cache, pulling directly: %v", originURL(repo), err))
+	}
+	return w.Pull(&git.PullOptions{
+		RemoteName:        "origin",
+		ReferenceName:     plumbing.NewBranchReferenceName(branch),
+		Auth:              authForRemote(originURL(repo)),
+		Progress:          os.Stdout,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+	})
+}
+
+// originURL returns the URL of the origin remote of a repository
+func originURL(repo *git.Repository) string {
+	remote, err := repo.Remote("origin")
+	if err != nil || len(remote.Config().URLs) == 0 {
+		return ""
+	}
+	return remote.Config().URLs[0]
+}
+
 // initSubModules initializes the submodules for a repository
 func initSubModules(repo *git.Repository, subApp *SubApplication) error {
 	logToMainFile(fmt.Sprintf("Initializing submodules for application: %s", subApp.Name))
@@ -175,18 +257,50 @@ func initSubModules(repo *git.Repository, subApp *SubApplication) error {
 			return err
 		}
 
-		err = submodule.Update(&git.SubmoduleUpdateOptions{
-			Init:              true,
-			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-		})
+		mirrored := false
+		if useMirrors() {
+			subRepo, err := submodule.Repository()
+			if err == nil {
+				err = fetchFromMirror(subRepo)
+				mirrored = err == nil || err == git.NoErrAlreadyUpToDate
+			}
+		}
+
+		err = submodule.Update(submoduleUpdateOptions(submodule, mirrored))
 		if err != nil {
 			logToMainFile(fmt.Sprintf("Failed to initialize submodule: %v", err))
 			return err
 		}
+		if mirrored {
+			subRepo, err := submodule.Repository()
+			if err == nil {
+				err = initSubModules(subRepo, subApp)
+			}
+			if err != nil {
+				return err
+			}
+		}
 	}
 	return nil
 }
 
+// submoduleUpdateOptions returns the options to update a submodule. When its objects come from
+// the mirror cache nothing is fetched and nested submodules are handled by the caller.
+func submoduleUpdateOptions(submodule *git.Submodule, mirrored bool) *git.SubmoduleUpdateOptions {
+	if mirrored {
+		return &git.SubmoduleUpdateOptions{
+			Init:              true,
+			NoFetch:           true,
+			RecurseSubmodules: git.NoRecurseSubmodules,
+		}
+	}
+	return &git.SubmoduleUpdateOptions{
+		Init:              true,
+		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
+		Auth:              authForRemote(submodule.Config().URL),
+	}
+}
+
 func updateSubModules(repo *git.Repository, subApp *SubApplication) error {
 	logToMainFile(fmt.Sprintf("Updating submodules for application: %s", subApp.Name))
 	w, err := repo.Worktree()
@@ -212,10 +326,7 @@ func updateSubModules(repo *git.Repository, subApp *SubApplication) error {
 			return err
 		}
 
-		err = repo.Fetch(&git.FetchOptions{
-			RemoteName: "origin",
-			Progress:   os.Stdout,
-		})
+		err = fetchOrigin(repo)
 		if err != nil {
 			if err != git.NoErrAlreadyUpToDate {
 				logToMainFile(fmt.Sprintf("Failed to update subapplication %s: %v", subApp.Name, err))
@@ -232,14 +343,17 @@ func updateSubModules(repo *git.Repository, subApp *SubApplication) error {
 			return err
 		}
 
-		err = submodule.Update(&git.SubmoduleUpdateOptions{
-			Init:              true,
-			RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-		})
+		err = submodule.Update(submoduleUpdateOptions(submodule, useMirrors()))
 		if err != nil {
 			logToMainFile(fmt.Sprintf("Failed to update submodule: %v", err))
 			return err
 		}
+		if useMirrors() {
+			err = updateSubModules(repo, subApp)
+			if err != nil {
+				return err
+			}
+		}
 		if stashed == 1 {
 			err = applyStashedChanges(repo)
 			if err != nil {
@@ -340,7 +454,7 @@ func stashChanges(repo *git.Repository) (int, error) {
 }
 
 func (subAppDef *SubApplication) uninstall() {
-	defer broadcastToSocket("kits", getAllKits())
+	defer getAllKits()
 	subApp := subAppDef.getCurrent()
 	if subApp == nil {
 		return
@@ -353,6 +467,11 @@ func (subAppDef *SubApplication) uninstall() {
 		return
 	}
 	os.RemoveAll(installLoc)
+	os.RemoveAll(getStagingLocation(installLoc))
+	if standbyLoc, err := subApp.getSlotLocation(subApp.getStandbySlot()); err == nil {
+		os.RemoveAll(standbyLoc)
+	}
+	removeNodeManifest(subApp.Id)
 	//remove from list
 	for i, s := range subApplications {
 		if s.Id == subApp.Id {
@@ -363,6 +482,7 @@ func (subAppDef *SubApplication) uninstall() {
 	saveSubApplications()
 }
 
+// checkUpdates fetches the sources and checks if the update channel has a newer version
 func (subAppDef *SubApplication) checkUpdates() bool {
 	subApp := subAppDef.getCurrent()
 	if subApp == nil {
@@ -374,52 +494,56 @@ func (subAppDef *SubApplication) checkUpdates() bool {
 		return false
 	}
 	r, err := git.PlainOpen(installLoc)
-	defer broadcastToSocket("subapplications", subApplications)
+	defer listStatesInternal()
 	if err != nil {
 		return false
-		// logToMainFile(fmt.Sprintf("Application not found %s for update, installing: %v", subApp.Name, err))
-		// os.RemoveAll(getInstallLocation(subApp))
-		// installed := installSubApplication(subApp)
-		// if !installed {
-		// 	return false
-		// }
-	}
-	//w, err := r.Worktree()
-	// if err != nil {
-	// 	logToMainFile(fmt.Sprintf("Failed to get worktree for subapplication %s: %v", subApp.Name, err))
-	// 	return false
-	// }
+	}
 	//git remote update
-	err = r.Fetch(&git.FetchOptions{
-		RemoteName: "origin",
-		Progress:   os.Stdout,
-	})
+	err = fetchOrigin(r)
 	if err != nil && err != git.NoErrAlreadyUpToDate {
 		logToMainFile(fmt.Sprintf("Failed to update subapplication %s: %v", subApp.Name, err))
 		return false
 	}
 
-	// err = w.Pull(&git.PullOptions{
-	// 	RemoteName:    "origin",
-	// 	ReferenceName: plumbing.NewBranchReferenceName(subApp.Branch),
-	// 	Progress:      os.Stdout,
-	// })
-	// if err != nil && err != git.NoErrAlreadyUpToDate {
-	// 	logToMainFile(fmt.Sprintf("Application is up to date %s: %v", subApp.Name, err))
-	// 	subApp.HasUpdates = false
-	// 	return false
-	// }
-
+	channel := subApp.getUpdatePolicy().Channel
+	target, hash, err := resolveUpdateTarget(r, channel)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Failed to check updates for subapplication %s: %v", subApp.Name, err))
+		return false
+	}
+	subApp.HasUpdates = false
+	subApp.AvailableUpdate = ""
+	head, err := r.Head()
+	if err == nil && head.Hash() == hash {
+		return false
+	}
+	if err == nil && !strings.HasPrefix(channel, tagChannelPrefix) {
+		// local commits ahead of the branch are not an update
+		ahead, err := isAncestor(r, hash, head.Hash())
+		if err == nil && ahead {
+			return false
+		}
+	}
 	subApp.HasUpdates = true
+	subApp.AvailableUpdate = target
 	return true
-
 }
 
 func (subAppDef *SubApplication) update() bool {
+	return subAppDef.updateWithTrigger("manual")
+}
+
+// updateWithTrigger updates the application to the latest version of its update channel
+// and records the outcome in its update history
+func (subAppDef *SubApplication) updateWithTrigger(trigger string) bool {
 	subApp := subAppDef.getCurrent()
 	if subApp == nil {
 		return false
 	}
+	if subApp.BlueGreen != nil && subApp.Installed {
+		logToMainFile(fmt.Sprintf("Updating subapplication alongside the live version: %s", subApp.Name))
+		return subApp.blueGreenUpdate(trigger)
+	}
 	subApp.updateStatus("Updating")
 	logToMainFile(fmt.Sprintf("Updating subapplication: %s", subApp.Name))
 	installLoc, err := getInstallLocation(subApp)
@@ -432,69 +556,96 @@ func (subAppDef *SubApplication) update() bool {
 
 		logToMainFile(fmt.Sprintf("Application not found %s for update, installing: %v", subApp.Name, err))
 		os.RemoveAll(installLoc)
+		subApp.Installed = false
 		installed := subApp.install()
 		return installed
 	}
-	err = r.Fetch(&git.FetchOptions{
-		RemoteName: "origin",
-		Progress:   os.Stdout,
-	})
 	if err != nil {
-		if err != git.NoErrAlreadyUpToDate {
-			logToMainFile(fmt.Sprintf("Failed to update subapplication %s: %v", subApp.Name, err))
-			return false
-		} else {
-			//don't update if there are no changes
-			return true
+		logToMainFile(fmt.Sprintf("Failed to open repository for subapplication %s: %v", subApp.Name, err))
+		return false
+	}
+	from := headCommit(r)
+	applied, err := subApp.pullUpdate(r, installLoc)
+	if applied || err != nil {
+		subApp.recordUpdate(trigger, from, headCommit(r), err)
+	}
+	if err != nil {
+		subApp.setLastError("update", err, "")
+		return false
+	}
+	subApp.LastError = nil
+	subApp.HasUpdates = false
+	subApp.AvailableUpdate = ""
+	saveSubApplications()
+	subApp.updateStatus("Installed")
+	return true
+}
+
+// pullUpdate brings the sources to the latest version of the update channel and runs the setup.
+// It reports whether anything was applied.
+func (subApp *SubApplication) pullUpdate(r *git.Repository, installLoc string) (bool, error) {
+	err := fetchOrigin(r)
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		logToMainFile(fmt.Sprintf("Failed to update subapplication %s: %v", subApp.Name, err))
+		return false, err
+	}
+	channel := subApp.getUpdatePolicy().Channel
+	_, hash, err := resolveUpdateTarget(r, channel)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Failed to resolve update channel for subapplication %s: %v", subApp.Name, err))
+		return false, err
+	}
+	if headCommit(r) == hash.String() {
+		//don't update if there are no changes, but finish a setup that failed last time
+		if subApp.hasFailedSetup("update") {
+			return true, subApp.finishUpdate(installLoc, true)
 		}
+		return false, nil
 	}
 	w, err := r.Worktree()
 	if err != nil {
 		logToMainFile(fmt.Sprintf("Failed to get worktree for subapplication %s: %v", subApp.Name, err))
-		return false
+		return false, err
 	}
 	stash, err := stashChanges(r)
 	if err != nil {
 		logToMainFile(fmt.Sprintf("Failed to stash changes for subapplication %s: %v", subApp.Name, err))
-		return false
+		return false, err
 	}
-	err = w.Pull(&git.PullOptions{
-		RemoteName:        "origin",
-		ReferenceName:     plumbing.NewBranchReferenceName(subApp.Branch),
-		Progress:          os.Stdout,
-		RecurseSubmodules: git.DefaultSubmoduleRecursionDepth,
-	})
+	err = checkoutTarget(r, w, channel, hash)
 	if stash == 1 {
-		err = applyStashedChanges(r)
-		if err != nil {
-			logToMainFile(fmt.Sprintf("Failed to apply stashed changes for subapplication %s: %v", subApp.Name, err))
-			return false
+		stashErr := applyStashedChanges(r)
+		if stashErr != nil {
+			logToMainFile(fmt.Sprintf("Failed to apply stashed changes for subapplication %s: %v", subApp.Name, stashErr))
+			return true, stashErr
 		}
 	}
 
 	if err != nil && err != git.NoErrAlreadyUpToDate {
 		logToMainFile(fmt.Sprintf("Failed to update subapplication %s: %v", subApp.Name, err))
-		return false
+		return true, err
 	}
 
 	err = updateSubModules(r, subApp)
 	if err != nil {
-		return false
-	}
-	err = subApp.runSetupCommand()
-	if err != nil {
-		return false
+		return true, err
 	}
-	subApp.checkSymLinks()
-	return true
+	return true, subApp.finishUpdate(installLoc, false)
 }
 
-func (subApp *SubApplication) checkSymLinks() {
-	installLoc, err := getInstallLocation(subApp)
+// finishUpdate runs the setup steps and symlinks after the sources were updated
+func (subApp *SubApplication) finishUpdate(installLoc string, resume bool) error {
+	err := subApp.runSetup(installLoc, resume)
 	if err != nil {
-		logToFile("log", fmt.Sprintf("Failed to get install location for subapplication %s: %v", subApp.Name, err), nil)
-		return
+		return err
 	}
+	subApp.checkSymLinks(installLoc)
+	subApp.checkPythonDrift(installLoc)
+	return nil
+}
+
+// checkSymLinks creates the symlinks of the subapplication inside installLoc
+func (subApp *SubApplication) checkSymLinks(installLoc string) {
 	links := subApp.SymLinks
 
 	for source, destination := range links {
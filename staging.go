@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how many lines of console output are kept for error reports
+var recentOutputLimit = 50
+
+var outputMu sync.Mutex
+
+// recordOutput keeps the last lines of console output of the subprocess
+func (subApp *SubApplication) recordOutput(line string) {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	subApp.recentOutput = append(subApp.recentOutput, redactSecrets(line))
+	if len(subApp.recentOutput) > recentOutputLimit {
+		subApp.recentOutput = subApp.recentOutput[len(subApp.recentOutput)-recentOutputLimit:]
+	}
+}
+
+// streamOutput sends the output of cmd to the console log of the application and keeps its last
+// lines for error reports. The process of the application is left alone, the returned group is
+// done once the output has been read to the end.
+func (subApp *SubApplication) streamOutput(cmd *exec.Cmd) (*sync.WaitGroup, error) {
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	var outputDone sync.WaitGroup
+	outputDone.Add(2)
+	for _, reader := range []io.Reader{stdout, stderr} {
+		go func(reader io.Reader) {
+			defer outputDone.Done()
+			scanner := bufio.NewScanner(reader)
+			for scanner.Scan() {
+				subApp.recordOutput(scanner.Text())
+				logToFile("console", scanner.Text(), subApp)
+			}
+		}(reader)
+	}
+	return &outputDone, nil
+}
+
+// clearRecentOutput forgets the output of the previous command
+func (subApp *SubApplication) clearRecentOutput() {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	subApp.recentOutput = nil
+}
+
+// getRecentOutput returns a copy of the last lines of console output
+func (subApp *SubApplication) getRecentOutput() []string {
+	outputMu.Lock()
+	defer outputMu.Unlock()
+	return append([]string(nil), subApp.recentOutput...)
+}
+
+// setLastError records a failed operation on the subapplication, keeping the recent output as log
+func (subApp *SubApplication) setLastError(operation string, err error, stagingDir string) {
+	subApp.recordLastError(operation, err, stagingDir)
+	subApp.updateStatus("Failed")
+	saveSubApplications()
+}
+
+// recordLastError records the failure without changing the status, for failures that leave
+// the running application untouched
+func (subApp *SubApplication) recordLastError(operation string, err error, stagingDir string) {
+	subApp.LastError = &SubApplicationError{
+		Operation:  operation,
+		Step:       failedStep(err),
+		Message:    err.Error(),
+		Time:       time.Now().Format(time.RFC3339),
+		StagingDir: stagingDir,
+		Log:        subApp.getRecentOutput(),
+	}
+	logToFile("log", fmt.Sprintf("%s failed: %v", operation, err), subApp, true)
+	if stagingDir != "" {
+		logToFile("log", fmt.Sprintf("Staging directory kept for inspection: %s", stagingDir), subApp)
+	}
+}
+
+// getStagingLocation returns the staging directory used while installing into installLoc.
+// It lives next to the install location so it can be renamed into place.
+func getStagingLocation(installLoc string) string {
+	return filepath.Join(filepath.Dir(installLoc), ".staging", filepath.Base(installLoc))
+}
+
+// prepareStagingLocation removes leftovers of a previous attempt and returns an empty staging directory
+func prepareStagingLocation(installLoc string) (string, error) {
+	stagingLoc := getStagingLocation(installLoc)
+	err := os.RemoveAll(stagingLoc)
+	if err != nil {
+		return "", fmt.Errorf("failed to clean staging directory %s: %v", stagingLoc, err)
+	}
+	folder, _, err := getFolderWithCreate(stagingLoc)
+	if err != nil {
+		return "", fmt.Errorf("failed to create staging directory %s: %v", stagingLoc, err)
+	}
+	return folder, nil
+}
+
+// swapIntoPlace replaces the install location with the fully prepared staging directory.
+// The kept paths of the install location are moved along, e.g. a python environment built where it ends up.
+func swapIntoPlace(stagingLoc string, installLoc string, keep ...string) error {
+	for _, path := range keep {
+		from := filepath.Join(installLoc, path)
+		if _, err := os.Stat(from); err != nil {
+			continue
+		}
+		to := filepath.Join(stagingLoc, path)
+		os.RemoveAll(to)
+		err := os.MkdirAll(filepath.Dir(to), os.ModePerm)
+		if err == nil {
+			err = os.Rename(from, to)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to keep %s: %v", from, err)
+		}
+	}
+	err := os.RemoveAll(installLoc)
+	if err != nil {
+		return fmt.Errorf("failed to clear install location %s: %v", installLoc, err)
+	}
+	err = os.Rename(stagingLoc, installLoc)
+	if err != nil {
+		return fmt.Errorf("failed to move %s into place: %v", stagingLoc, err)
+	}
+	// remove the staging parent if nothing else is being staged
+	os.Remove(filepath.Dir(stagingLoc))
+	return nil
+}
+
+// isEmptyDir checks if a directory has no entries
+func isEmptyDir(dir string) bool {
+	f, err := os.Open(dir)
+	if err != nil {
+		return true
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(1)
+	return len(names) == 0
+}
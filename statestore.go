@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// StateStore keeps the state of the daemon: configuration, applications, credentials and caches.
+// Entries are addressed by logical names like config or history/config/12, the store decides
+// where they are kept.
+type StateStore interface {
+	// Read returns the content stored under name, an error satisfying os.IsNotExist if there is none
+	Read(name string) ([]byte, error)
+	// Write replaces the content stored under name, all at once or not at all
+	Write(name string, content []byte) error
+	// Update replaces the content stored under name with what update returns for the current
+	// content, nil if there is none. Writers are serialized, so updates don't interleave.
+	Update(name string, update func(previous []byte) ([]byte, error)) error
+	// Remove deletes the content stored under name, removing what isn't there is no error
+	Remove(name string) error
+	// Version returns a token that changes whenever the content stored under name changes,
+	// also when it is changed outside the daemon. It is an error satisfying os.IsNotExist if there is none.
+	Version(name string) (string, error)
+}
+
+// names of the state entries
+const (
+	stateConfig               = "config"
+	stateSubApplications      = "subapplications"
+	stateSubApplicationStates = "subapplications.state"
+	stateCredentials          = "credentials"
+	stateSecrets              = "secrets"
+	stateKitCatalog           = "kitcatalog"
+)
+
+// entries readable only by the service account
+var privateStateEntries = map[string]bool{stateCredentials: true, stateSecrets: true}
+
+var stateStore StateStore
+var stateStoreOnce sync.Once
+
+// getStateStore returns the store of the daemon, files next to the executable
+func getStateStore() StateStore {
+	stateStoreOnce.Do(func() {
+		runningPath, err := getCurrentPath()
+		if err != nil {
+			runningPath = "."
+		}
+		stateStore = &fileStateStore{dir: runningPath}
+	})
+	return stateStore
+}
+
+// fileStateStore keeps each name in a json file, replaced through a synced temporary file so a crash
+// leaves either the old or the new content
+type fileStateStore struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// path returns the file name is kept in: the config file can be moved on the command line, the kit
+// catalog lives in the data folder and everything else is name.json under the folder of the store
+func (store *fileStateStore) path(name string) (string, error) {
+	switch name {
+	case stateConfig:
+		return getConfigFile()
+	case stateKitCatalog:
+		dataLoc, err := getDataLocation()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(dataLoc, kitCatalogFile), nil
+	}
+	if !isSafeRelativePath(name) {
+		return "", fmt.Errorf("invalid state name %s", name)
+	}
+	return filepath.Join(store.dir, filepath.FromSlash(name)+".json"), nil
+}
+
+func (store *fileStateStore) Read(name string) ([]byte, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (store *fileStateStore) Write(name string, content []byte) error {
+	return store.Update(name, func(previous []byte) ([]byte, error) {
+		return content, nil
+	})
+}
+
+func (store *fileStateStore) Update(name string, update func(previous []byte) ([]byte, error)) error {
+	// resolved before locking, finding the data folder may save the configuration
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	previous, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	content, err := update(previous)
+	if err != nil {
+		return err
+	}
+	mode := os.FileMode(0644)
+	if privateStateEntries[name] {
+		mode = 0600
+	}
+	return writeFileAtomic(path, content, mode)
+}
+
+func (store *fileStateStore) Remove(name string) error {
+	path, err := store.path(name)
+	if err != nil {
+		return err
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (store *fileStateStore) Version(name string) (string, error) {
+	path, err := store.path(name)
+	if err != nil {
+		return "", err
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", info.ModTime().UnixNano(), info.Size()), nil
+}
+
+// writeFileAtomic writes content to a synced temporary file next to path and renames it over path
+func writeFileAtomic(path string, content []byte, mode os.FileMode) error {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	temp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tempPath := temp.Name()
+	_, err = temp.Write(content)
+	if err == nil {
+		err = temp.Sync()
+	}
+	closeErr := temp.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tempPath, mode)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+	// a reader holding the file open makes the rename fail on windows for a moment
+	for attempt := 0; ; attempt++ {
+		err = os.Rename(tempPath, path)
+		if err == nil || attempt == 4 {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		os.Remove(tempPath)
+		return fmt.Errorf("failed to replace %s: %v", path, err)
+	}
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -15,31 +16,50 @@ var subApplicationFile string = "subapplications.json"
 
 // SubApplication represents a subprocess configuration
 type SubApplication struct {
-	Id                     string             `json:"id"`                     // Unique identifier for the subprocess
-	Name                   string             `json:"name"`                   // Name of the subprocess
-	CommandExec            string             `json:"commandExec"`            // Command to start the subprocess
-	Command                string             `json:"command"`                // Command to start the subprocess
-	RestartOnCriticalError bool               `json:"restartOnCriticalError"` // Indicates if the subprocess should be restarted on critical error
-	CriticalErrorMessages  []string           `json:"criticalErrorMessages"`  // Messages that warrant restart
-	AutoStart              bool               `json:"autoStart"`              // Indicates if the subprocess should be started automatically
-	RepoURL                string             `json:"repoURL"`                // URL of the repository
-	Branch                 string             `json:"branch"`                 // Branch to checkout
-	Path                   string             `json:"path"`                   // Path to the repository
-	AutoUpdate             bool               `json:"autoUpdate"`             // Indicates if the repository should be updated automatically
-	Flags                  []string           `json:"flags"`                  // Flags to pass to the subprocess
-	AppType                string             `json:"appType"`                // Type of the application
-	FirstRun               bool               `json:"firstRun"`               // Indicates if the application is running for the first time
-	Installed              bool               `json:"installed"`              // Indicates if the application is installed
-	HasUpdates             bool               `json:"hasUpdates"`             // Indicates if the application has updates
-	LogLocation            string             `json:"-"`                      // Location of the log files
-	SetupCommand           string             `json:"setupCommand"`           // Command to run after installation
-	LogFile                *os.File           `json:"-"`                      // Log file for the subprocess, don't serialize
-	Context                context.Context    `json:"-"`                      // Process object for the subprocess
-	Cmd                    *exec.Cmd          `json:"-"`                      // Process object for the subprocess
-	CancelContext          context.CancelFunc `json:"-"`                      // Cancel function for the subprocess
-	Running                bool               `json:"running"`                // Indicates if the subprocess is running
-	Status                 string             `json:"status"`                 // Status of the subprocess
-	SymLinks               map[string]string  `json:"symLinks"`               // Symlinks to create
+	Id                     string                 `json:"id"`                     // Unique identifier for the subprocess
+	Name                   string                 `json:"name"`                   // Name of the subprocess
+	CommandExec            string                 `json:"commandExec"`            // Command to start the subprocess
+	Command                string                 `json:"command"`                // Command to start the subprocess
+	RestartOnCriticalError bool                   `json:"restartOnCriticalError"` // Indicates if the subprocess should be restarted on critical error
+	CriticalErrorMessages  []string               `json:"criticalErrorMessages"`  // Messages that warrant restart
+	AutoStart              bool                   `json:"autoStart"`              // Indicates if the subprocess should be started automatically
+	RepoURL                string                 `json:"repoURL"`                // URL of the repository
+	Branch                 string                 `json:"branch"`                 // Branch to checkout
+	Commit                 string                 `json:"commit,omitempty"`       // Commit checked out when installing, pinned by exported kits
+	Path                   string                 `json:"path"`                   // Path to the repository
+	AutoUpdate             bool                   `json:"autoUpdate"`             // Applies updates automatically when no update policy says otherwise
+	Flags                  []string               `json:"flags"`                  // Flags to pass to the subprocess
+	AppType                string                 `json:"appType"`                // Type of the application
+	LogLocation            string                 `json:"-"`                      // Location of the log files
+	SetupCommand           string                 `json:"setupCommand,omitempty"` // Legacy single setup command, converted to a setup step when loaded
+	SetupSteps             []SetupStep            `json:"setupSteps"`             // Ordered steps to run after installation and updates
+	LogFile                *os.File               `json:"-"`                      // Log file for the subprocess, don't serialize
+	Context                context.Context        `json:"-"`                      // Process object for the subprocess
+	Cmd                    *exec.Cmd              `json:"-"`                      // Process object for the subprocess
+	CancelContext          context.CancelFunc     `json:"-"`                      // Cancel function for the subprocess
+	SymLinks               map[string]string      `json:"symLinks"`               // Symlinks to create
+	Python                 *PythonEnvironment     `json:"python"`                 // Python environment managed by the daemon
+	UpdatePolicy           *UpdatePolicy          `json:"updatePolicy"`           // Channel, mode and maintenance window of automatic updates
+	BlueGreen              *BlueGreenConfig       `json:"blueGreen"`              // Updates in a second checkout, switched to after a health check
+	Parameters             map[string]string      `json:"parameters"`             // Kit parameters the application was rendered with
+	KitId                  string                 `json:"kitId"`                  // Kit the application was created from
+	KitVersion             string                 `json:"kitVersion"`             // Version of the kit the application was created from or last upgraded to
+	KitBase                map[string]interface{} `json:"kitBase"`                // Kit definition the application was created from, the base of kit upgrades
+	Requirements           *KitRequirements       `json:"requirements"`           // What the application needs from the host, checked before installing
+	SubApplicationState    `json:"-"`             // Runtime state, kept apart from the definition
+	recentOutput           []string               // Tail of the console output of the last command, used for error reports
+	outputDone             *sync.WaitGroup        // Done once the output of the last command has been read
+	pythonHome             string                 // Install location the python environment is built in while the install is staged
+}
+
+// SubApplicationError describes the last failed operation of a subapplication
+type SubApplicationError struct {
+	Operation  string   `json:"operation"`  // Operation that failed (install, update...)
+	Step       string   `json:"step"`       // Step of the operation that failed
+	Message    string   `json:"message"`    // Error message
+	Time       string   `json:"time"`       // When the failure happened
+	StagingDir string   `json:"stagingDir"` // Staging directory kept for inspection, if any
+	Log        []string `json:"log"`        // Last lines of output before the failure
 }
 
 type SubApplicationStatus struct {
@@ -78,51 +98,26 @@ func (subApp *SubApplication) calculateFlags() {
 	}
 }
 
-// runSetupCommand runs the setup command for the subprocess
-func (subApp *SubApplication) runSetupCommand() error {
-	if subApp.SetupCommand == "" {
-		return nil
-	}
-	fullPath, err := getInstallLocation(subApp)
-	if err != nil {
-		logToFile("log", fmt.Sprintf("Failed to get install location for subapplication %s: %v", subApp.Name, err), subApp)
-		return err
-	}
-	command := subApp.SetupCommand
-	command = strings.Replace(command, "$dir", fullPath, -1)
-	commandParams := strings.Split(command, " ")
-	command = commandParams[0]
-
-	joinedRest := strings.Join(commandParams[1:], " ")
-
-	cmd, err := subApp.createCommand(command, "Installing")
-	subApp.CancelContext = nil
-	subApp.Context = nil
-	subApp.Cmd = nil
-	if err != nil {
-		logToFile("log", fmt.Sprintf("Error creating command for subapplication %s: %v", subApp.Name, err), subApp)
-		subApp.updateStatus("Failed")
-		return err
-	}
-
-	cmd.SysProcAttr = &syscall.SysProcAttr{HideWindow: true, CmdLine: joinedRest}
-	cmd.Dir = fullPath
-	logToFile("log", fmt.Sprintf("Running setup command for subapplication %s: %s", subApp.Name, command), subApp)
-	logToFile("log", fmt.Sprintf("	with params: %s", joinedRest), subApp)
-
-	err = cmd.Start()
-	if err != nil {
-		logToMainFile(fmt.Sprintf("Failed to run setup command for subapplication %s: %v", subApp.Name, err))
-		return err
+// expandPlaceholders replaces ${python}, ${dir}, $dir and ${secret:NAME} in value for the application installed in dir
+// Secrets are expanded last, so their values are taken as they are.
+func (subApp *SubApplication) expandPlaceholders(value string, dir string) (string, error) {
+	if strings.Contains(value, "${python}") {
+		python, err := subApp.pythonExecutable(dir)
+		if err != nil {
+			return "", err
+		}
+		value = strings.Replace(value, "${python}", python, -1)
 	}
-	cmd.Wait()
-	return nil
+	value = strings.Replace(value, "${dir}", dir, -1)
+	value = strings.Replace(value, "$dir", dir, -1)
+	return expandSecrets(value), nil
 }
 
 // createCommand creates a command for the subprocess
 func (subApp *SubApplication) createCommand(command string, status string) (*exec.Cmd, error) {
 	ctx, cancel := context.WithCancel(context.Background())
 	cmd := exec.CommandContext(ctx, command)
+	subApp.clearRecentOutput()
 	subApp.CancelContext = cancel
 	subApp.Context = ctx
 	subApp.Cmd = cmd
@@ -167,7 +162,11 @@ func (subApp *SubApplication) createCommand(command string, status string) (*exe
 	// go readPipe(stdoutReader, output)
 	// go readPipe(stderrReader, errors)
 
+	var outputDone sync.WaitGroup
+	outputDone.Add(2)
+	subApp.outputDone = &outputDone
 	go func() {
+		defer outputDone.Done()
 		// for {
 		// 	msg := <-output
 		// 	updateStatusSubApplication(subApp, "Running")
@@ -185,6 +184,7 @@ func (subApp *SubApplication) createCommand(command string, status string) (*exe
 		scanner := bufio.NewScanner(stdoutReader)
 		for scanner.Scan() {
 			subApp.updateStatus(status)
+			subApp.recordOutput(scanner.Text())
 			logToFile("console", scanner.Text(), subApp)
 
 			if subApp.RestartOnCriticalError {
@@ -199,12 +199,14 @@ func (subApp *SubApplication) createCommand(command string, status string) (*exe
 	}()
 
 	go func() {
+		defer outputDone.Done()
 		// for {
 		// 	msg := <-errors
 		// 	logToFile("console", msg, subApp)
 		// }
 		scanner := bufio.NewScanner(stderrReader)
 		for scanner.Scan() {
+			subApp.recordOutput(scanner.Text())
 			logToFile("console", scanner.Text(), subApp)
 		}
 	}()
@@ -218,8 +220,8 @@ func (subAppDef *SubApplication) start() {
 		return
 	}
 
-	if subApp.AutoUpdate {
-		subApp.update()
+	if subApp.canApplyUpdate(time.Now()) {
+		subApp.updateWithTrigger("start")
 	}
 	subApp.updateStatus("Starting")
 	if subApp.FirstRun {
@@ -253,13 +255,20 @@ func (subAppDef *SubApplication) start() {
 		logToFile("log", fmt.Sprintf("Failed to get install location for subapplication %s: %v", subApp.Name, err), subApp)
 		return
 	}
-	command = strings.Replace(command, "$dir", fullPath, -1)
-	commandExec = strings.Replace(commandExec, "$dir", fullPath, -1)
+	command, err = subApp.expandPlaceholders(command, fullPath)
+	if err == nil {
+		commandExec, err = subApp.expandPlaceholders(commandExec, fullPath)
+	}
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Failed to start subapplication %s: %v", subApp.Name, err), subApp, true)
+		subApp.updateStatus("Failed")
+		return
+	}
 	logToMainFile(fmt.Sprintf("Starting subprocess: %s", commandExec))
 	logToMainFile(fmt.Sprintf("	with params: %s", command))
 	logToMainFile(fmt.Sprintf("	in directory: %s", fullPath))
 
-	cmd, err := subApp.createCommand(subApp.CommandExec, "Running")
+	cmd, err := subApp.createCommand(commandExec, "Running")
 	if err != nil {
 		logToFile("log", fmt.Sprintf("Error creating command for subapplication %s: %v", subApp.Name, err), subApp)
 		subApp.updateStatus("Failed")
@@ -348,8 +357,8 @@ func (subAppDef *SubApplication) getCurrent() *SubApplication {
 	return nil
 }
 
-// modify modifies the subprocess, restarting it if necessary
-func (subApp *SubApplication) modify() *SubApplication {
+// modify modifies the subprocess, restarting it if necessary, actor is recorded in the history
+func (subApp *SubApplication) modify(actor string) *SubApplication {
 	for i, s := range subApplications {
 		if s.Id == subApp.Id {
 			var subApp = subApplications[i]
@@ -358,7 +367,7 @@ func (subApp *SubApplication) modify() *SubApplication {
 				subApp.stop()
 			}
 			subApplications[i] = subApp
-			saveSubApplications()
+			saveSubApplicationsAs(actor, "modified application "+subApp.Id)
 			if running {
 				subApp.start()
 			}
@@ -368,9 +377,9 @@ func (subApp *SubApplication) modify() *SubApplication {
 	return nil
 }
 
-// add adds a subprocess to the list
-func (subApp *SubApplication) add() *SubApplication {
-	defer broadcastToSocket("kits", getAllKits())
+// add adds a subprocess to the list, actor is recorded in the history
+func (subApp *SubApplication) add(actor string) *SubApplication {
+	defer getAllKits()
 	defer listApplicationsInternal()
 	if subApp.Id == "" {
 		id, err := generateId()
@@ -387,9 +396,15 @@ func (subApp *SubApplication) add() *SubApplication {
 			return nil
 		}
 	}
+	if err := subApp.checkKitAllowed(); err != nil {
+		logToMainFile(fmt.Sprintf("Refusing to add subapplication %s: %v", subApp.Name, err))
+		return nil
+	}
 
+	subApp.normalizeSetupSteps()
+	subApp.moveURLCredentials()
 	subApplications = append(subApplications, subApp)
-	saveSubApplications()
+	saveSubApplicationsAs(actor, "added application "+subApp.Id)
 	subApp.install()
 	if subApp.AutoStart {
 		subApp.start()
@@ -397,17 +412,17 @@ func (subApp *SubApplication) add() *SubApplication {
 	return subApp
 }
 
-// remove removes a subprocess from the list
-
-func (subApp *SubApplication) remove() {
-	defer broadcastToSocket("kits", getAllKits())
-	for i, s := range subApplications {
-		if s.Id == subApp.Id {
+// remove removes a subprocess from the list, stopping it first.
+// The running state is the one of the stored application, clients don't send it.
+func (subAppDef *SubApplication) remove(actor string) {
+	defer getAllKits()
+	for i, subApp := range subApplications {
+		if subApp.Id == subAppDef.Id {
 			if subApp.Running {
 				subApp.stop()
 			}
 			subApplications = append(subApplications[:i], subApplications[i+1:]...)
-			saveSubApplications()
+			saveSubApplicationsAs(actor, "removed application "+subApp.Id)
 			return
 		}
 	}
@@ -3,8 +3,6 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"os"
-	"path/filepath"
 )
 
 // notifySubApplicationsStatusChange notifies all connected clients of the status of all subapplications
@@ -26,28 +24,21 @@ func getStatusOnlyArray(subApps []*SubApplication) []*SubApplicationStatus {
 func readSubApplications() ([]*SubApplication, error) {
 	var subApplications []*SubApplication
 
-	runningPath, err := getCurrentPath()
+	content, err := getStateStore().Read(stateSubApplications)
 	if err != nil {
-		logToMainFile(fmt.Sprintf("Error getting running path: %v", err))
+		logToMainFile(fmt.Sprintf("Error opening config file: %v", err))
 		return nil, err
 	}
-	fullPath := filepath.Join(runningPath, subApplicationFile)
-
-	configFile, err := os.Open(fullPath)
-
+	err = json.Unmarshal(content, &subApplications)
 	if err != nil {
-		logToMainFile(fmt.Sprintf("Error opening config file: %v", err))
+		logToMainFile(fmt.Sprintf("Error decoding config file: %v", err))
 		return nil, err
-
-	} else {
-		err = json.NewDecoder(configFile).Decode(&subApplications)
-		if err != nil {
-			logToMainFile(fmt.Sprintf("Error decoding config file: %v", err))
-			return nil, err
-		}
 	}
 
-	defer configFile.Close()
+	for _, subApp := range subApplications {
+		subApp.normalizeSetupSteps()
+	}
+	readSubApplicationStates(subApplications, content)
 	return subApplications, nil
 }
 
@@ -70,8 +61,9 @@ func checkSubApplicationUpdatesInternal() {
 		}
 	}
 	if hasUpdates {
-		broadcastToSocket("subapplications", subApplications)
+		broadcastToSocket("appstates", getStates(subApplications))
 	}
+	checkKitUpgrades()
 }
 
 // startAllSubApplications starts all subapplications that are set to autostart
@@ -83,19 +75,24 @@ func stopAllSubApplications() {
 
 // saveSubApplications saves the subapplications to the subApplicationFile
 func saveSubApplications() {
-	configFile, err := os.Create(subApplicationFile)
-	if err != nil {
-		logToMainFile(fmt.Sprintf("Error creating config file: %v", err))
-		return
-	}
-	defer configFile.Close()
+	saveSubApplicationsAs("daemon", "")
+}
 
-	encoder := json.NewEncoder(configFile)
-	encoder.SetIndent("", "    ")
-	err = encoder.Encode(subApplications)
+// saveSubApplicationsAs saves the definitions of the subapplications and keeps a version if they
+// changed, recording who changed them and why. The runtime state is saved apart.
+func saveSubApplicationsAs(actor string, reason string) {
+	var previous, content []byte
+	// encoded while holding the store, so a slower save can't overwrite a newer state
+	err := getStateStore().Update(stateSubApplications, func(stored []byte) ([]byte, error) {
+		encoded, err := json.MarshalIndent(subApplications, "", "    ")
+		previous, content = stored, encoded
+		return append(encoded, '\n'), err
+	})
 	if err != nil {
-		logToMainFile(fmt.Sprintf("Error encoding config file: %v", err))
+		logToMainFile(fmt.Sprintf("Error saving config file: %v", err))
+		return
 	}
+	recordVersion(historySubApplications, content, previous, actor, reason)
 	broadcastToSocket("subapplications", subApplications)
-
+	saveSubApplicationStates()
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// placeholder of a kit parameter in the kit template, e.g. {{port}}
+var kitParameterPattern = regexp.MustCompile(`{{\s*([A-Za-z0-9_]+)\s*}}`)
+
+// types a kit parameter may have
+var kitParameterTypes = []string{"string", "int", "bool", "path", "choice"}
+
+// KitParameter is a value asked when a kit is added, rendered into the kit template
+type KitParameter struct {
+	Name        string   `json:"name"`        // Name used in the {{name}} placeholders
+	Type        string   `json:"type"`        // string, int, bool, path or choice
+	Default     string   `json:"default"`     // Value used when none is given
+	Description string   `json:"description"` // Shown to the user
+	Required    bool     `json:"required"`    // A value must be given if there is no default
+	Choices     []string `json:"choices"`     // Allowed values of a choice parameter
+	Min         *int     `json:"min"`         // Minimum of an int parameter
+	Max         *int     `json:"max"`         // Maximum of an int parameter
+}
+
+// AppRequest adds an application, optionally from the kit given by kitId rendered with parameters
+type AppRequest struct {
+	SubApplication
+	Parameters map[string]string `json:"parameters"` // Values of the kit parameters
+}
+
+// getType returns the type of the parameter, string by default
+func (param *KitParameter) getType() string {
+	if param.Type == "" {
+		return "string"
+	}
+	return strings.ToLower(param.Type)
+}
+
+// resolve checks the value given for the parameter, falling back to its default
+func (param *KitParameter) resolve(value string, given bool) (string, error) {
+	if !given || value == "" {
+		value = param.Default
+	}
+	if value == "" {
+		if param.Required {
+			return "", fmt.Errorf("parameter %s is required", param.Name)
+		}
+		return "", nil
+	}
+	switch param.getType() {
+	case "int":
+		number, err := strconv.Atoi(value)
+		if err != nil {
+			return "", fmt.Errorf("parameter %s must be a number", param.Name)
+		}
+		if param.Min != nil && number < *param.Min {
+			return "", fmt.Errorf("parameter %s must be at least %d", param.Name, *param.Min)
+		}
+		if param.Max != nil && number > *param.Max {
+			return "", fmt.Errorf("parameter %s must be at most %d", param.Name, *param.Max)
+		}
+		return strconv.Itoa(number), nil
+	case "bool":
+		flag, err := strconv.ParseBool(value)
+		if err != nil {
+			return "", fmt.Errorf("parameter %s must be true or false", param.Name)
+		}
+		return strconv.FormatBool(flag), nil
+	case "choice":
+		for _, choice := range param.Choices {
+			if value == choice {
+				return value, nil
+			}
+		}
+		return "", fmt.Errorf("parameter %s must be one of %s", param.Name, strings.Join(param.Choices, ", "))
+	}
+	return value, nil
+}
+
+// validateParameters checks the parameter declarations and that the template only uses declared ones
+func (kit *Kit) validateParameters() []string {
+	errors := []string{}
+	declared := make(map[string]bool)
+	for i, param := range kit.Parameters {
+		if param.Name == "" {
+			errors = append(errors, fmt.Sprintf("parameter %d has no name", i+1))
+			continue
+		}
+		if declared[param.Name] {
+			errors = append(errors, fmt.Sprintf("parameter %s is declared twice", param.Name))
+		}
+		declared[param.Name] = true
+		validType := false
+		for _, paramType := range kitParameterTypes {
+			if param.getType() == paramType {
+				validType = true
+			}
+		}
+		if !validType {
+			errors = append(errors, fmt.Sprintf("parameter %s has type %s, expected one of %s", param.Name, param.Type, strings.Join(kitParameterTypes, ", ")))
+		} else if param.Default != "" {
+			if _, err := param.resolve(param.Default, true); err != nil {
+				errors = append(errors, fmt.Sprintf("default of parameter %s is invalid: %v", param.Name, err))
+			}
+		}
+		if param.getType() == "choice" && len(param.Choices) == 0 {
+			errors = append(errors, fmt.Sprintf("parameter %s has no choices", param.Name))
+		}
+	}
+	template, err := json.Marshal(kit.SubApplication)
+	if err != nil {
+		return append(errors, fmt.Sprintf("template can't be encoded: %v", err))
+	}
+	for _, match := range kitParameterPattern.FindAllStringSubmatch(string(template), -1) {
+		if !declared[match[1]] {
+			errors = append(errors, fmt.Sprintf("placeholder {{%s}} has no matching parameter", match[1]))
+			declared[match[1]] = true
+		}
+	}
+	return errors
+}
+
+// render builds the application from the kit template and the given parameter values
+func (kit *Kit) render(values map[string]string) (*SubApplication, error) {
+	resolved := make(map[string]string)
+	var problems []string
+	for name := range values {
+		found := false
+		for _, param := range kit.Parameters {
+			if param.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("unknown parameter %s", name))
+		}
+	}
+	for _, param := range kit.Parameters {
+		value, given := values[param.Name]
+		value, err := param.resolve(value, given)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		resolved[param.Name] = value
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, fmt.Errorf("invalid parameters: %s", strings.Join(problems, "; "))
+	}
+
+	template, err := json.Marshal(kit.SubApplication)
+	if err != nil {
+		return nil, err
+	}
+	rendered := kitParameterPattern.ReplaceAllStringFunc(string(template), func(placeholder string) string {
+		value := resolved[kitParameterPattern.FindStringSubmatch(placeholder)[1]]
+		// the value lands inside a JSON string, escape it the same way
+		encoded, _ := json.Marshal(value)
+		return string(encoded[1 : len(encoded)-1])
+	})
+	var subApp SubApplication
+	err = json.Unmarshal([]byte(rendered), &subApp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render kit %s: %v", kit.Name, err)
+	}
+	subApp.Flags = removeEmptyFlags(subApp.Flags)
+	subApp.Parameters = resolved
+
+	// parameters may produce values the template itself didn't have, e.g. an unsafe path
+	check := Kit{SubApplication: subApp, SchemaVersion: kit.SchemaVersion}
+	if problems := check.validate(); len(problems) > 0 {
+		return nil, fmt.Errorf("rendered kit %s is invalid: %s", kit.Name, strings.Join(problems, "; "))
+	}
+	return &subApp, nil
+}
+
+// removeEmptyFlags drops flags left empty by optional parameters
+func removeEmptyFlags(flags []string) []string {
+	var kept []string
+	for _, flag := range flags {
+		if strings.TrimSpace(flag) != "" {
+			kept = append(kept, flag)
+		}
+	}
+	return kept
+}
+
+// findKit returns the kit with the given id from the catalog
+func findKit(id string) *Kit {
+	if id == "" {
+		return nil
+	}
+	for _, kit := range getKitCatalog(false).Kits {
+		if kit.Id == id {
+			return &kit
+		}
+	}
+	return nil
+}
+
+// addApplication adds the application of the request. Applications from a kit are built from
+// the catalog entry, rendered with the parameters if it declares any, never taken as sent.
+// They get an id of their own, the kit is recorded in KitId.
+func (request *AppRequest) addApplication(actor string) (*SubApplication, error) {
+	subApp := request.SubApplication
+	kit := findKit(request.KitId)
+	if request.KitId != "" && kit == nil {
+		logToMainFile(fmt.Sprintf("Failed to add subapplication %s: kit %s not found", subApp.Name, request.KitId))
+		return nil, fmt.Errorf("kit %s not found", request.KitId)
+	}
+	if kit != nil {
+		if len(kit.Parameters) > 0 || len(request.Parameters) > 0 {
+			rendered, err := kit.render(request.Parameters)
+			if err != nil {
+				logToMainFile(fmt.Sprintf("Failed to add subapplication %s: %v", kit.Name, err))
+				return nil, err
+			}
+			subApp = *rendered
+		} else {
+			subApp = kit.SubApplication
+		}
+		subApp.Id = ""
+		definition := subApp
+		subApp.trackKit(kit, &definition)
+	}
+	added := subApp.add(actor)
+	if added == nil {
+		return nil, fmt.Errorf("failed to add subapplication %s", subApp.Name)
+	}
+	return added, nil
+}
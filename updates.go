@@ -0,0 +1,341 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// channels starting with this prefix follow the highest tag matching the rest, e.g. tag:v*
+var tagChannelPrefix = "tag:"
+
+// number of entries kept in the update history of each application
+var updateHistoryLimit = 20
+
+// port ComfyUI listens on when none is given in the command
+var defaultComfyPort = "8188"
+
+var versionNumbers = regexp.MustCompile(`\d+`)
+
+// UpdatePolicy controls how new versions of a subapplication are picked up
+type UpdatePolicy struct {
+	Channel string             `json:"channel"` // Branch to follow, or tag:<pattern> for the highest matching tag. Defaults to the application branch
+	Mode    string             `json:"mode"`    // check only reports updates, apply also installs them
+	Window  *MaintenanceWindow `json:"window"`  // When updates may be applied automatically, any time if not set
+}
+
+// MaintenanceWindow is a daily time range, in local time, during which updates may be applied
+type MaintenanceWindow struct {
+	Days  []string `json:"days"`  // Days of the week (mon, tue...), every day if empty
+	Start string   `json:"start"` // Start time, HH:MM
+	End   string   `json:"end"`   // End time, HH:MM, earlier than start for windows spanning midnight
+}
+
+// UpdateRecord is an entry of the update history of a subapplication
+type UpdateRecord struct {
+	Time    string `json:"time"`    // When the update finished
+	Trigger string `json:"trigger"` // manual, scheduled or start
+	Channel string `json:"channel"` // Channel the update came from
+	From    string `json:"from"`    // Commit before the update
+	To      string `json:"to"`      // Commit after the update
+	Result  string `json:"result"`  // applied or failed
+	Error   string `json:"error"`   // Error of a failed update
+}
+
+// UpdateDeferredEvent is broadcast when an update is postponed because the application is busy
+type UpdateDeferredEvent struct {
+	AppId  string `json:"appId"`
+	Update string `json:"update"`
+	Reason string `json:"reason"`
+}
+
+// getUpdatePolicy returns the update policy, applying the defaults.
+// Without a policy, autoUpdate applies updates at any time and otherwise updates are only checked.
+func (subApp *SubApplication) getUpdatePolicy() UpdatePolicy {
+	policy := UpdatePolicy{}
+	if subApp.UpdatePolicy != nil {
+		policy = *subApp.UpdatePolicy
+	}
+	if policy.Mode == "" {
+		policy.Mode = "check"
+		if subApp.AutoUpdate {
+			policy.Mode = "apply"
+		}
+	}
+	if policy.Channel == "" {
+		policy.Channel = subApp.Branch
+	}
+	return policy
+}
+
+// canApplyUpdate checks if a pending update may be applied automatically now.
+// An update that already failed is left to a manual update until the channel moves on.
+func (subApp *SubApplication) canApplyUpdate(now time.Time) bool {
+	policy := subApp.getUpdatePolicy()
+	if subApp.FailedUpdate != "" && subApp.FailedUpdate == subApp.AvailableUpdate {
+		return false
+	}
+	return subApp.HasUpdates && subApp.Installed && policy.Mode == "apply" && policy.Window.contains(now)
+}
+
+// contains checks if the time falls inside the window, a nil window is always open
+func (window *MaintenanceWindow) contains(now time.Time) bool {
+	if window == nil {
+		return true
+	}
+	if len(window.Days) > 0 {
+		today := strings.ToLower(now.Weekday().String()[:3])
+		found := false
+		for _, day := range window.Days {
+			day = strings.ToLower(strings.TrimSpace(day))
+			if len(day) >= 3 && day[:3] == today {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if window.Start == "" && window.End == "" {
+		return true
+	}
+	start, err := time.Parse("15:04", window.Start)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Invalid maintenance window start %s: %v", window.Start, err))
+		return false
+	}
+	end, err := time.Parse("15:04", window.End)
+	if err != nil {
+		logToMainFile(fmt.Sprintf("Invalid maintenance window end %s: %v", window.End, err))
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+// resolveUpdateTarget returns the name and commit of the latest version on the channel.
+// A branch channel without a branch follows the branch currently checked out.
+func resolveUpdateTarget(repo *git.Repository, channel string) (string, plumbing.Hash, error) {
+	if strings.HasPrefix(channel, tagChannelPrefix) {
+		return latestTag(repo, strings.TrimPrefix(channel, tagChannelPrefix))
+	}
+	branch := channel
+	if branch == "" {
+		head, err := repo.Storer.Reference(plumbing.HEAD)
+		if err != nil || head.Type() != plumbing.SymbolicReference {
+			return "", plumbing.ZeroHash, fmt.Errorf("no branch to follow")
+		}
+		branch = head.Target().Short()
+	}
+	ref, err := repo.Storer.Reference(plumbing.NewRemoteReferenceName("origin", branch))
+	if err != nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("branch %s not found: %v", branch, err)
+	}
+	return ref.Hash().String()[:7], ref.Hash(), nil
+}
+
+// latestTag returns the highest version tag matching pattern and the commit it points to
+func latestTag(repo *git.Repository, pattern string) (string, plumbing.Hash, error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	var best *plumbing.Reference
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		if matched, _ := path.Match(pattern, ref.Name().Short()); !matched {
+			return nil
+		}
+		if best == nil || compareVersions(ref.Name().Short(), best.Name().Short()) > 0 {
+			best = ref
+		}
+		return nil
+	})
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	if best == nil {
+		return "", plumbing.ZeroHash, fmt.Errorf("no tag matches %s", pattern)
+	}
+	hash := best.Hash()
+	if tag, err := repo.TagObject(hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return "", plumbing.ZeroHash, err
+		}
+		hash = commit.Hash
+	}
+	return best.Name().Short(), hash, nil
+}
+
+// compareVersions compares the numbers in two version strings, e.g. v1.10.0 > v1.9.2
+func compareVersions(a string, b string) int {
+	numbersA := versionNumbers.FindAllString(a, -1)
+	numbersB := versionNumbers.FindAllString(b, -1)
+	for i := 0; i < len(numbersA) && i < len(numbersB); i++ {
+		x, _ := strconv.Atoi(numbersA[i])
+		y, _ := strconv.Atoi(numbersB[i])
+		if x != y {
+			if x > y {
+				return 1
+			}
+			return -1
+		}
+	}
+	if len(numbersA) != len(numbersB) {
+		if len(numbersA) > len(numbersB) {
+			return 1
+		}
+		return -1
+	}
+	return strings.Compare(a, b)
+}
+
+// checkoutTarget moves the worktree to the latest version of the channel
+func checkoutTarget(repo *git.Repository, w *git.Worktree, channel string, hash plumbing.Hash) error {
+	if strings.HasPrefix(channel, tagChannelPrefix) {
+		return w.Checkout(&git.CheckoutOptions{Hash: hash})
+	}
+	if channel == "" {
+		head, err := repo.Storer.Reference(plumbing.HEAD)
+		if err != nil {
+			return err
+		}
+		channel = head.Target().Short()
+	}
+	branchRef := plumbing.NewBranchReferenceName(channel)
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+	if head.Type() != plumbing.SymbolicReference || head.Target() != branchRef {
+		_, err = repo.Storer.Reference(branchRef)
+		if err != nil {
+			// the channel branch was never checked out, start it at the remote commit
+			return w.Checkout(&git.CheckoutOptions{Branch: branchRef, Hash: hash, Create: true})
+		}
+		err = w.Checkout(&git.CheckoutOptions{Branch: branchRef})
+		if err != nil {
+			return err
+		}
+	}
+	return pullBranch(repo, w, channel)
+}
+
+// headCommit returns the commit checked out in the repository, empty if unknown
+func headCommit(repo *git.Repository) string {
+	head, err := repo.Head()
+	if err != nil {
+		return ""
+	}
+	return head.Hash().String()
+}
+
+// recordUpdate adds the outcome of an update to the history of the application
+func (subApp *SubApplication) recordUpdate(trigger string, from string, to string, err error) {
+	record := UpdateRecord{
+		Time:    time.Now().Format(time.RFC3339),
+		Trigger: trigger,
+		Channel: subApp.getUpdatePolicy().Channel,
+		From:    from,
+		To:      to,
+		Result:  "applied",
+	}
+	if err != nil {
+		record.Result = "failed"
+		record.Error = err.Error()
+		subApp.FailedUpdate = subApp.AvailableUpdate
+		if subApp.FailedUpdate != "" {
+			logToFile("log", fmt.Sprintf("Update to %s failed, it won't be applied automatically again until the channel moves", subApp.FailedUpdate), subApp, true)
+		}
+	} else {
+		subApp.FailedUpdate = ""
+	}
+	subApp.UpdateHistory = append(subApp.UpdateHistory, record)
+	if len(subApp.UpdateHistory) > updateHistoryLimit {
+		subApp.UpdateHistory = subApp.UpdateHistory[len(subApp.UpdateHistory)-updateHistoryLimit:]
+	}
+	saveSubApplications()
+}
+
+// isBusy checks if the application is doing work that an update would interrupt
+func (subApp *SubApplication) isBusy() (bool, string) {
+	if subApp.Status == "Installing" || subApp.Status == "Updating" {
+		return true, strings.ToLower(subApp.Status)
+	}
+	if !subApp.Running || !subApp.supportsCustomNodes() {
+		return false, ""
+	}
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(fmt.Sprintf("http://127.0.0.1:%s/queue", subApp.getPort()))
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Failed to read the queue, assuming idle: %v", err), subApp)
+		return false, ""
+	}
+	defer resp.Body.Close()
+	var queue struct {
+		Running []json.RawMessage `json:"queue_running"`
+		Pending []json.RawMessage `json:"queue_pending"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&queue)
+	if err != nil {
+		logToFile("log", fmt.Sprintf("Failed to decode the queue, assuming idle: %v", err), subApp)
+		return false, ""
+	}
+	if len(queue.Running)+len(queue.Pending) > 0 {
+		return true, fmt.Sprintf("%d queued jobs", len(queue.Running)+len(queue.Pending))
+	}
+	return false, ""
+}
+
+// getPort returns the port given with --port in the command or flags, or the ComfyUI default
+func (subApp *SubApplication) getPort() string {
+	// flags may hold an option and its value in a single entry, e.g. "--port 8181"
+	args := strings.Fields(subApp.Command + " " + strings.Join(subApp.Flags, " "))
+	for i, arg := range args {
+		if strings.HasPrefix(arg, "--port=") {
+			return strings.TrimPrefix(arg, "--port=")
+		}
+		if arg == "--port" && i+1 < len(args) {
+			return args[i+1]
+		}
+	}
+	return defaultComfyPort
+}
+
+// applyPendingUpdates applies the updates found by the last check to the applications whose
+// policy allows it, deferring them while the application is busy
+func applyPendingUpdates() {
+	now := time.Now()
+	for _, subApp := range subApplications {
+		if !subApp.canApplyUpdate(now) {
+			continue
+		}
+		if busy, reason := subApp.isBusy(); busy {
+			logToFile("log", fmt.Sprintf("Deferring update to %s: %s", subApp.AvailableUpdate, reason), subApp)
+			broadcastToSocket("updatedeferred", UpdateDeferredEvent{AppId: subApp.Id, Update: subApp.AvailableUpdate, Reason: reason})
+			continue
+		}
+		// blue/green updates keep the application running until the switch
+		wasRunning := subApp.Running && subApp.BlueGreen == nil
+		if wasRunning {
+			subApp.stop()
+		}
+		subApp.updateWithTrigger("scheduled")
+		if wasRunning {
+			subApp.start()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log"
 
 	"golang.org/x/sys/windows/svc"
@@ -70,7 +71,11 @@ func runService(name string, isDebug bool) {
 }
 
 func (m *myService) runMainService(eventLog *eventlog.Log) {
-	run()
+	err := run()
+	if err != nil {
+		eventLog.Error(1, fmt.Sprintf("Failed to start: %v", err))
+		log.Fatalf("failed to start: %v", err)
+	}
 	eventLog.Info(1, "Main service started")
 
 	<-m.quit